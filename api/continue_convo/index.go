@@ -3,13 +3,12 @@ package continue_convo_go
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"os"
 
 	"github.com/passage-inc/chatassist/packages/vercel/common"
-	gogpt "github.com/sashabaranov/go-gpt3"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -19,56 +18,142 @@ type postRequest struct {
 }
 
 type postResponse struct {
-	Response string `json:"response"`
+	Response       string             `json:"response"`
+	Sources        []common.Source    `json:"sources"`
+	ConversationId primitive.ObjectID `json:"conversation_id"`
+	// the answer as appended to the conversation, with its model, latency and usage
+	Turn common.Turn `json:"turn"`
+	// false when the domain had nothing relevant, and the answer says so
+	Answerable bool `json:"answerable"`
+	Success    bool `json:"success"`
 }
 
-func handlePost(w *http.ResponseWriter, r *http.Request) {
-	c := gogpt.NewClient(os.Getenv("OPENAI_API_KEY"))
+func handlePost(w *http.ResponseWriter, r *http.Request) error {
+	c := common.GetCompleter()
 	ctx := context.TODO()
-	db, disconnect := common.GetDb()
-	defer disconnect()
+	store, err := common.GetStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
 
 	var req postRequest
 	// parse from request body
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err = json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		panic(err.Error())
+		return common.ValidationError("invalid request body: %s", err.Error())
+	}
+	if req.Message == "" {
+		return common.ValidationError("message is required")
 	}
 
 	log.Output(1, "finding convo with id"+req.ConversationId.String())
 
 	// find conversation with matching ID
-	var convo common.Conversation
-	db.Collection("Conversations").FindOne(ctx, bson.D{{"_id", req.ConversationId}}).Decode(&convo)
+	convo, err := store.GetConversation(ctx, req.ConversationId)
+	if err != nil {
+		return common.StoreError(err, "conversation "+req.ConversationId.Hex())
+	}
 
-	// find the domain with the correct domainId
-	var domain common.Domain
-	db.Collection("ScrapedDomains").FindOne(ctx, bson.D{{"_id", convo.DomainId}}).Decode(&domain)
+	// conversations follow the active snapshot of their domain, so a re-scrape or
+	// rollback applies to them from the next message on
+	if convo.Domain == "" {
+		legacy, err := store.GetDomainById(ctx, convo.DomainId)
+		if errors.Is(err, common.ErrNotFound) {
+			return common.NotFoundError("the domain of conversation %s no longer exists", req.ConversationId.Hex())
+		} else if err != nil {
+			return common.StoreError(err, "domain")
+		}
+		convo.Domain = legacy.Domain
+	}
+	domain, err := store.GetDomain(ctx, convo.Domain)
+	if errors.Is(err, common.ErrNotFound) {
+		return common.NotFoundError("the domain of conversation %s no longer exists", req.ConversationId.Hex())
+	} else if err != nil {
+		return common.StoreError(err, "domain")
+	}
+	convo.DomainId = domain.Id
 
 	convo.AppendUser(req.Message)
-	agentResponse := common.GetConversationCompletion(c, convo, domain)
-	convo.AppendAgent(agentResponse)
+	cfg, err := common.FindDomainConfig(ctx, store, domain.Domain)
+	if err != nil {
+		return err
+	}
+	// whatever no longer fits into the prompt is summarized before it is left out
+	common.SummarizeHistory(ctx, c, &convo, cfg.Completion)
+	model, err := common.EmbedderForModel(domain.EmbeddingModel)
+	if err != nil {
+		return common.InternalError(err)
+	}
+	embedder := common.NewCachedEmbedder(model, store)
+
+	// with an event stream the answer is sent piece by piece, and the final event
+	// carries the same response a plain request gets
+	var stream *common.EventStream
+	var turn common.Turn
+	if common.WantsEventStream(r) {
+		stream = common.NewEventStream(*w)
+		// the request's context ends the upstream stream when the client goes away
+		turn, err = common.StreamConversationCompletion(r.Context(), store, c, embedder, convo, domain, cfg, func(delta string) error {
+			return stream.Send("delta", common.StreamDelta{Content: delta})
+		})
+	} else {
+		turn, err = common.GetConversationCompletion(ctx, store, c, embedder, convo, domain, cfg)
+	}
+	// questions without relevant content still get an answer, saying as much
+	var unanswerable *common.UnanswerableError
+	if errors.As(err, &unanswerable) {
+		log.Output(1, "unanswerable: "+err.Error())
+	} else if err != nil {
+		return err
+	}
+	hits, misses := embedder.Stats()
+	log.Output(1, fmt.Sprintf("embedding cache: %d hits, %d misses", hits, misses))
+	convo.AppendTurn(turn)
 
 	log.Output(1, "persisting conversation")
 
 	// update convo in database
-	_, err = db.Collection("Conversations").UpdateOne(ctx, bson.M{"_id": req.ConversationId}, bson.M{"$set": bson.M{"log": convo.Log}})
+	err = store.UpdateConversation(ctx, convo)
 	if err != nil {
-		panic(err.Error())
+		return common.StoreError(err, "conversation")
+	}
+	if unanswerable != nil {
+		common.RecordUnanswered(ctx, store, convo, req.Message, unanswerable)
 	}
 
 	log.Output(1, "responding")
 	response := postResponse{
-		Response: agentResponse,
+		Response:       turn.Content,
+		Sources:        turn.Sources,
+		ConversationId: req.ConversationId,
+		Turn:           turn,
+		Answerable:     unanswerable == nil,
+		Success:        true,
+	}
+
+	if stream != nil {
+		return stream.Send("done", response)
 	}
 
 	(*w).Header().Set("Content-Type", "application/json")
-	json.NewEncoder(*w).Encode(response)
+	return json.NewEncoder(*w).Encode(response)
 }
 
 func Handler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	if r.Method == "POST" {
-		handlePost(&w, r)
+	defer common.Recover(w)
+
+	var err error
+	switch r.Method {
+	case "POST":
+		err = handlePost(&w, r)
+	case "OPTIONS":
+		// nothing to do for CORS preflights
+	default:
+		err = common.MethodNotAllowedError(r.Method)
+	}
+	if err != nil {
+		common.WriteError(w, err)
 	}
 }
@@ -0,0 +1,249 @@
+package conversations
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/passage-inc/chatassist/packages/vercel/common"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// how many conversations a page of the list has unless it asks for a number, and at most
+const (
+	DEFAULT_CONVERSATION_LIMIT = 20
+	MAX_CONVERSATION_LIMIT     = 100
+)
+
+// how long the preview of a conversation in the list is, in characters
+const PREVIEW_LENGTH = 120
+
+type conversationInfo struct {
+	Id        primitive.ObjectID `json:"id"`
+	Domain    string             `json:"domain"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"` // when the last turn was added
+	TurnCount int                `json:"turn_count"`
+	Preview   string             `json:"preview"` // the first question
+}
+
+type conversationResponse struct {
+	conversationInfo
+	Summary string        `json:"summary,omitempty"`
+	Turns   []common.Turn `json:"turns"`
+	Success bool          `json:"success"`
+}
+
+type listResponse struct {
+	Domain        string             `json:"domain"`
+	Conversations []conversationInfo `json:"conversations"`
+	// pass as ?before= for the next page, empty on the last one
+	NextCursor string `json:"next_cursor,omitempty"`
+	Success    bool   `json:"success"`
+}
+
+type deleteResponse struct {
+	Id      primitive.ObjectID `json:"id"`
+	Success bool               `json:"success"`
+}
+
+func info(c common.Conversation) conversationInfo {
+	res := conversationInfo{
+		Id:        c.Id,
+		Domain:    c.Domain,
+		CreatedAt: c.Id.Timestamp(),
+		UpdatedAt: c.Id.Timestamp(),
+		TurnCount: len(c.Turns),
+	}
+	if len(c.Turns) > 0 {
+		res.UpdatedAt = c.Turns[len(c.Turns)-1].CreatedAt
+	}
+	for _, v := range c.Turns {
+		if v.Role == common.ROLE_USER {
+			res.Preview = v.Content
+			if runes := []rune(res.Preview); len(runes) > PREVIEW_LENGTH {
+				res.Preview = string(runes[:PREVIEW_LENGTH]) + "…"
+			}
+			break
+		}
+	}
+	return res
+}
+
+func conversationId(r *http.Request) (primitive.ObjectID, error) {
+	rawId := common.RouteParam(r, "conversations", "id")
+	id, err := primitive.ObjectIDFromHex(rawId)
+	if err != nil {
+		return id, common.ValidationError("invalid conversation id %q", rawId)
+	}
+	return id, nil
+}
+
+// dateParam reads ?key= as RFC 3339 or as a date. A date given as ?to= includes the
+// whole of that day
+func dateParam(r *http.Request, key string) (time.Time, error) {
+	raw := r.URL.Query().Get(key)
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", raw)
+	if err != nil {
+		return t, common.ValidationError("invalid %s %q, expected a date or an RFC 3339 time", key, raw)
+	}
+	if key == "to" {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// handleList lists the conversations of the domain in /domains/{domain}/conversations,
+// newest first, optionally started between ?from= and ?to=. Pages of ?limit= are
+// followed with ?before= set to the next_cursor of the previous one
+func handleList(w http.ResponseWriter, r *http.Request, store common.Store, rawDomain string) error {
+	ctx := context.TODO()
+	params := r.URL.Query()
+
+	domain, err := common.EncodeDomain(rawDomain)
+	if err != nil || domain == "" {
+		return common.ValidationError("invalid domain %q", rawDomain)
+	}
+	limit := DEFAULT_CONVERSATION_LIMIT
+	if raw := params.Get("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > MAX_CONVERSATION_LIMIT {
+			return common.ValidationError("limit must be between 1 and %d", MAX_CONVERSATION_LIMIT)
+		}
+	}
+	filter := common.ConversationFilter{Domain: domain, Limit: limit + 1}
+	if filter.From, err = dateParam(r, "from"); err != nil {
+		return err
+	}
+	if filter.To, err = dateParam(r, "to"); err != nil {
+		return err
+	}
+	if raw := params.Get("before"); raw != "" {
+		filter.Before, err = primitive.ObjectIDFromHex(raw)
+		if err != nil {
+			return common.ValidationError("invalid cursor %q", raw)
+		}
+	}
+
+	// conversations started before snapshots only know the snapshot they were started on
+	snapshots, err := store.ListSnapshots(ctx, domain)
+	if err != nil {
+		return common.StoreError(err, "versions of "+domain)
+	}
+	for _, v := range snapshots {
+		filter.DomainIds = append(filter.DomainIds, v.Id)
+	}
+
+	convos, err := store.ListConversations(ctx, filter)
+	if err != nil {
+		return common.StoreError(err, "conversations")
+	}
+	res := listResponse{
+		Domain:        domain,
+		Conversations: make([]conversationInfo, 0, limit),
+		Success:       true,
+	}
+	// one more than the limit is asked for, to tell whether there is a next page
+	if len(convos) > limit {
+		convos = convos[:limit]
+		res.NextCursor = convos[limit-1].Id.Hex()
+	}
+	for _, v := range convos {
+		item := info(v)
+		if item.Domain == "" {
+			item.Domain = domain
+		}
+		res.Conversations = append(res.Conversations, item)
+	}
+	log.Output(1, fmt.Sprintf("listed %d conversations of %s", len(res.Conversations), domain))
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res)
+}
+
+// handleGet returns the transcript of /conversations/{id}, or lists conversations if
+// the path is /domains/{domain}/conversations
+func handleGet(w http.ResponseWriter, r *http.Request, store common.Store) error {
+	if domain := common.RouteParam(r, "domains", "domain"); domain != "" {
+		return handleList(w, r, store, domain)
+	}
+
+	id, err := conversationId(r)
+	if err != nil {
+		return err
+	}
+	convo, err := store.GetConversation(context.TODO(), id)
+	if err != nil {
+		return common.StoreError(err, "conversation "+id.Hex())
+	}
+
+	res := conversationResponse{
+		conversationInfo: info(convo),
+		Summary:          convo.Summary,
+		Turns:            convo.Turns,
+		Success:          true,
+	}
+	if res.Turns == nil {
+		res.Turns = []common.Turn{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res)
+}
+
+// handleDelete deletes /conversations/{id} for good, with the unanswered questions
+// recorded from it
+func handleDelete(w http.ResponseWriter, r *http.Request, store common.Store) error {
+	id, err := conversationId(r)
+	if err != nil {
+		return err
+	}
+	if err := store.DeleteConversation(context.TODO(), id); err != nil {
+		return common.StoreError(err, "conversation "+id.Hex())
+	}
+	log.Output(1, "deleted conversation "+id.Hex())
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(deleteResponse{Id: id, Success: true})
+}
+
+func handle(w http.ResponseWriter, r *http.Request) error {
+	if err := common.RequireAdmin(r); err != nil {
+		return err
+	}
+
+	store, err := common.GetStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	switch r.Method {
+	case "GET":
+		return handleGet(w, r, store)
+	case "DELETE":
+		return handleDelete(w, r, store)
+	default:
+		return common.MethodNotAllowedError(r.Method)
+	}
+}
+
+// Handler serves transcripts to admins alone, see common.RequireAdmin. Unlike the chat
+// endpoints it sets no CORS headers, so no widget page can call it from a browser
+func Handler(w http.ResponseWriter, r *http.Request) {
+	defer common.Recover(w)
+
+	if err := handle(w, r); err != nil {
+		common.WriteError(w, err)
+	}
+}
@@ -0,0 +1,122 @@
+package domain_config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/passage-inc/chatassist/packages/vercel/common"
+)
+
+type configResponse struct {
+	Config  common.DomainConfig `json:"config"`
+	Success bool                `json:"success"`
+}
+
+func domainParam(r *http.Request) (string, error) {
+	domain, err := common.EncodeDomain(r.URL.Query().Get("domain"))
+	if err != nil || domain == "" {
+		return "", common.ValidationError("a valid domain is required")
+	}
+	return domain, nil
+}
+
+func respond(w http.ResponseWriter, cfg common.DomainConfig) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(configResponse{Config: cfg, Success: true})
+}
+
+// configError turns a store error about the config of domain into one for the client
+func configError(err error, domain string) error {
+	if errors.Is(err, common.ErrNotFound) {
+		return common.NotFoundError("no config found for %s", domain)
+	}
+	return common.StoreError(err, "domain config")
+}
+
+func handleGet(w http.ResponseWriter, r *http.Request, store common.Store) error {
+	domain, err := domainParam(r)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := store.GetDomainConfig(context.TODO(), domain)
+	if err != nil {
+		return configError(err, domain)
+	}
+	return respond(w, cfg)
+}
+
+// handlePut creates or replaces the configuration of the domain in the body
+func handlePut(w http.ResponseWriter, r *http.Request, store common.Store) error {
+	var cfg common.DomainConfig
+	err := json.NewDecoder(r.Body).Decode(&cfg)
+	if err != nil {
+		return common.ValidationError("invalid request body: %s", err.Error())
+	}
+	cfg.Domain, err = common.EncodeDomain(cfg.Domain)
+	if err != nil {
+		return common.ValidationError("invalid domain: %s", err.Error())
+	}
+	if err := cfg.Validate(); err != nil {
+		return common.ValidationError(err.Error())
+	}
+
+	log.Output(1, "saving config of "+cfg.Domain)
+	cfg, err = store.PutDomainConfig(context.TODO(), cfg)
+	if err != nil {
+		return configError(err, cfg.Domain)
+	}
+	return respond(w, cfg)
+}
+
+func handleDelete(w http.ResponseWriter, r *http.Request, store common.Store) error {
+	domain, err := domainParam(r)
+	if err != nil {
+		return err
+	}
+
+	log.Output(1, "deleting config of "+domain)
+	err = store.DeleteDomainConfig(context.TODO(), domain)
+	if err != nil {
+		return configError(err, domain)
+	}
+	return respond(w, common.DomainConfig{Domain: domain})
+}
+
+func handle(w http.ResponseWriter, r *http.Request) error {
+	// reading is open to anyone, changing anything is for admins
+	if r.Method != "GET" {
+		if err := common.RequireAdmin(r); err != nil {
+			return err
+		}
+	}
+
+	store, err := common.GetStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	switch r.Method {
+	case "GET":
+		return handleGet(w, r, store)
+	case "POST", "PUT":
+		return handlePut(w, r, store)
+	case "DELETE":
+		return handleDelete(w, r, store)
+	default:
+		return common.MethodNotAllowedError(r.Method)
+	}
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	common.AllowReads(w, r)
+	defer common.Recover(w)
+
+	if err := handle(w, r); err != nil {
+		common.WriteError(w, err)
+	}
+}
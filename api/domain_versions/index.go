@@ -0,0 +1,281 @@
+package domain_versions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/passage-inc/chatassist/packages/vercel/common"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type versionInfo struct {
+	Id             primitive.ObjectID `json:"id"`
+	Version        int                `json:"version"`
+	CreatedAt      time.Time          `json:"created_at"`
+	PageCount      int                `json:"page_count"`
+	SectionCount   int                `json:"section_count"`
+	EmbeddingModel string             `json:"embedding_model"`
+	Active         bool               `json:"active"`
+}
+
+type versionsResponse struct {
+	Domain   string        `json:"domain"`
+	Versions []versionInfo `json:"versions"`
+	Success  bool          `json:"success"`
+}
+
+type diffResponse struct {
+	Domain            string      `json:"domain"`
+	From              versionInfo `json:"from"`
+	To                versionInfo `json:"to"`
+	PageCountDelta    int         `json:"page_count_delta"`
+	SectionCountDelta int         `json:"section_count_delta"`
+	AddedRoutes       []string    `json:"added_routes"`
+	RemovedRoutes     []string    `json:"removed_routes"`
+	Success           bool        `json:"success"`
+}
+
+type rollbackRequest struct {
+	Domain string `json:"domain"`
+	// the version to make active. Defaults to the newest one older than the active one
+	Version *int `json:"version"`
+}
+
+// versions lists the snapshots of domain, newest first, and which one is active
+func versions(ctx context.Context, store common.Store, domain string) ([]versionInfo, error) {
+	active, err := store.GetDomain(ctx, domain)
+	if err != nil {
+		return nil, common.StoreError(err, "domain "+domain)
+	}
+	snapshots, err := store.ListSnapshots(ctx, domain)
+	if err != nil {
+		return nil, common.StoreError(err, "versions of "+domain)
+	}
+
+	res := make([]versionInfo, len(snapshots))
+	for i, v := range snapshots {
+		res[i] = versionInfo{
+			Id:             v.Id,
+			Version:        v.Version,
+			CreatedAt:      v.CreatedAt,
+			PageCount:      v.PageCount,
+			SectionCount:   v.SectionCount,
+			EmbeddingModel: v.EmbeddingModel,
+			Active:         v.Id == active.Id,
+		}
+	}
+	return res, nil
+}
+
+// find returns the entry of infos with version, or the active one if version is nil.
+// Snapshots stored before versions have version 0, which is a version like any other
+func find(infos []versionInfo, version *int) (versionInfo, error) {
+	for _, v := range infos {
+		if (version == nil && v.Active) || (version != nil && v.Version == *version) {
+			return v, nil
+		}
+	}
+	if version == nil {
+		return versionInfo{}, common.NotFoundError("no version is active")
+	}
+	return versionInfo{}, common.NotFoundError("version %d not found", *version)
+}
+
+// versionParam reads the version in ?key=, nil if there is none
+func versionParam(r *http.Request, key string) (*int, error) {
+	raw := r.URL.Query().Get(key)
+	if raw == "" {
+		return nil, nil
+	}
+	version, err := strconv.Atoi(raw)
+	if err != nil || version < 0 {
+		return nil, common.ValidationError("invalid %s version %q", key, raw)
+	}
+	return &version, nil
+}
+
+func routes(ctx context.Context, store common.Store, id primitive.ObjectID) (map[string]bool, error) {
+	pages, err := store.GetPages(ctx, id)
+	if err != nil {
+		return nil, common.StoreError(err, "pages")
+	}
+	res := make(map[string]bool, len(pages))
+	for _, v := range pages {
+		res[v.Route] = true
+	}
+	return res, nil
+}
+
+// handleDiff compares the pages of the from and to versions, to defaulting to the active one
+func handleDiff(w http.ResponseWriter, r *http.Request, store common.Store, domain string, infos []versionInfo) error {
+	fromVersion, err := versionParam(r, "from")
+	if err != nil {
+		return err
+	}
+	toVersion, err := versionParam(r, "to")
+	if err != nil {
+		return err
+	}
+	from, err := find(infos, fromVersion)
+	if err != nil {
+		return err
+	}
+	to, err := find(infos, toVersion)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.TODO()
+	fromRoutes, err := routes(ctx, store, from.Id)
+	if err != nil {
+		return err
+	}
+	toRoutes, err := routes(ctx, store, to.Id)
+	if err != nil {
+		return err
+	}
+
+	res := diffResponse{
+		Domain:            domain,
+		From:              from,
+		To:                to,
+		PageCountDelta:    to.PageCount - from.PageCount,
+		SectionCountDelta: to.SectionCount - from.SectionCount,
+		AddedRoutes:       []string{},
+		RemovedRoutes:     []string{},
+		Success:           true,
+	}
+	for route := range toRoutes {
+		if !fromRoutes[route] {
+			res.AddedRoutes = append(res.AddedRoutes, route)
+		}
+	}
+	for route := range fromRoutes {
+		if !toRoutes[route] {
+			res.RemovedRoutes = append(res.RemovedRoutes, route)
+		}
+	}
+	sort.Strings(res.AddedRoutes)
+	sort.Strings(res.RemovedRoutes)
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res)
+}
+
+func respond(w http.ResponseWriter, domain string, infos []versionInfo) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(versionsResponse{Domain: domain, Versions: infos, Success: true})
+}
+
+// handleGet lists the versions of ?domain=, or diffs two of them if ?from= is given
+func handleGet(w http.ResponseWriter, r *http.Request, store common.Store) error {
+	domain, err := common.EncodeDomain(r.URL.Query().Get("domain"))
+	if err != nil || domain == "" {
+		return common.ValidationError("a valid domain is required")
+	}
+
+	infos, err := versions(context.TODO(), store, domain)
+	if err != nil {
+		return err
+	}
+	if r.URL.Query().Get("from") != "" {
+		return handleDiff(w, r, store, domain, infos)
+	}
+	return respond(w, domain, infos)
+}
+
+// handlePost rolls the domain in the body back to an earlier version
+func handlePost(w http.ResponseWriter, r *http.Request, store common.Store) error {
+	var req rollbackRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return common.ValidationError("invalid request body: %s", err.Error())
+	}
+	domain, err := common.EncodeDomain(req.Domain)
+	if err != nil || domain == "" {
+		return common.ValidationError("a valid domain is required")
+	}
+	if req.Version != nil && *req.Version < 0 {
+		return common.ValidationError("invalid version %d", *req.Version)
+	}
+
+	ctx := context.TODO()
+	infos, err := versions(ctx, store, domain)
+	if err != nil {
+		return err
+	}
+
+	var target versionInfo
+	if req.Version != nil {
+		target, err = find(infos, req.Version)
+		if err != nil {
+			return err
+		}
+	} else {
+		active, err := find(infos, nil)
+		if err != nil {
+			return err
+		}
+		// versions are listed newest first
+		found := false
+		for _, v := range infos {
+			if v.Version < active.Version {
+				target, found = v, true
+				break
+			}
+		}
+		if !found {
+			return common.NotFoundError("%s has no version older than %d", domain, active.Version)
+		}
+	}
+
+	log.Output(1, fmt.Sprintf("activating version %d of %s", target.Version, domain))
+	if err := store.ActivateSnapshot(ctx, domain, target.Id); err != nil {
+		return common.StoreError(err, "version "+strconv.Itoa(target.Version))
+	}
+
+	infos, err = versions(ctx, store, domain)
+	if err != nil {
+		return err
+	}
+	return respond(w, domain, infos)
+}
+
+func handle(w http.ResponseWriter, r *http.Request) error {
+	// reading is open to anyone, changing anything is for admins
+	if r.Method != "GET" {
+		if err := common.RequireAdmin(r); err != nil {
+			return err
+		}
+	}
+
+	store, err := common.GetStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	switch r.Method {
+	case "GET":
+		return handleGet(w, r, store)
+	case "POST":
+		return handlePost(w, r, store)
+	default:
+		return common.MethodNotAllowedError(r.Method)
+	}
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	common.AllowReads(w, r)
+	defer common.Recover(w)
+
+	if err := handle(w, r); err != nil {
+		common.WriteError(w, err)
+	}
+}
@@ -3,14 +3,12 @@ package initialize_convo_go
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"net/url"
-	"os"
 
 	"github.com/passage-inc/chatassist/packages/vercel/common"
-	gogpt "github.com/sashabaranov/go-gpt3"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -21,70 +19,135 @@ type postRequest struct {
 
 type postResponse struct {
 	Answer         string             `json:"answer"`
+	Sources        []common.Source    `json:"sources"`
 	ConversationId primitive.ObjectID `json:"conversation_id"`
-	Error          string             `json:"error,omitempty"`
-	Success        bool               `json:"success"`
+	// the answer as appended to the conversation, with its model, latency and usage
+	Turn common.Turn `json:"turn"`
+	// false when the domain had nothing relevant, and the answer says so
+	Answerable bool `json:"answerable"`
+	Success    bool `json:"success"`
 }
 
-func handlePost(w *http.ResponseWriter, r *http.Request) {
-	c := gogpt.NewClient(os.Getenv("OPENAI_API_KEY"))
+func handlePost(w *http.ResponseWriter, r *http.Request) error {
+	c := common.GetCompleter()
 	ctx := context.TODO()
-	db, disconnect := common.GetDb()
-	defer disconnect()
+	store, err := common.GetStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
 
 	var req postRequest
 	// parse from request body
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err = json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		panic(err.Error())
+		return common.ValidationError("invalid request body: %s", err.Error())
+	}
+	if req.Question == "" {
+		return common.ValidationError("question is required")
 	}
 
-  parsed, err := url.Parse(req.Domain)
-  if err != nil {
-    panic(err)
-  }
-  decodedDomain := parsed.Host + parsed.Path
+	decodedDomain, err := common.EncodeDomain(req.Domain)
+	if err != nil || decodedDomain == "" {
+		return common.ValidationError("invalid domain %q", req.Domain)
+	}
 	log.Output(1, "finding domain"+decodedDomain)
 
-	item := db.Collection("ScrapedDomains").FindOne(ctx, bson.D{{"domain", decodedDomain}})
-	var targetDomain common.Domain
-	item.Decode(&targetDomain)
+	targetDomain, err := store.GetDomain(ctx, decodedDomain)
+	if errors.Is(err, common.ErrNotFound) {
+		return common.NotFoundError("domain %s has not been scraped", decodedDomain)
+	} else if err != nil {
+		return common.StoreError(err, "domain")
+	}
 
 	convo := common.Conversation{
 		DomainId: targetDomain.Id,
-		Log:      []string{},
+		Domain:   targetDomain.Domain,
+		Turns:    []common.Turn{},
 	}
   convo.AppendUser(req.Question)
 
 	log.Output(1, "constructing key matrix")
 
-	agentResponse := common.GetConversationCompletion(c, convo, targetDomain)
-  convo.AppendAgent(agentResponse)
+	cfg, err := common.FindDomainConfig(ctx, store, targetDomain.Domain)
+	if err != nil {
+		return err
+	}
+	model, err := common.EmbedderForModel(targetDomain.EmbeddingModel)
+	if err != nil {
+		return common.InternalError(err)
+	}
+	embedder := common.NewCachedEmbedder(model, store)
+
+	// with an event stream the answer is sent piece by piece, and the final event
+	// carries the same response a plain request gets
+	var stream *common.EventStream
+	var turn common.Turn
+	if common.WantsEventStream(r) {
+		stream = common.NewEventStream(*w)
+		// the request's context ends the upstream stream when the client goes away
+		turn, err = common.StreamConversationCompletion(r.Context(), store, c, embedder, convo, targetDomain, cfg, func(delta string) error {
+			return stream.Send("delta", common.StreamDelta{Content: delta})
+		})
+	} else {
+		turn, err = common.GetConversationCompletion(ctx, store, c, embedder, convo, targetDomain, cfg)
+	}
+	// questions without relevant content still get an answer, saying as much
+	var unanswerable *common.UnanswerableError
+	if errors.As(err, &unanswerable) {
+		log.Output(1, "unanswerable: "+err.Error())
+	} else if err != nil {
+		return err
+	}
+	hits, misses := embedder.Stats()
+	log.Output(1, fmt.Sprintf("embedding cache: %d hits, %d misses", hits, misses))
+	convo.AppendTurn(turn)
 
 	log.Output(1, "uploading conversation")
 
 	// save convo to database
-	res3, err := db.Collection("Conversations").InsertOne(context.TODO(), convo)
+	convo, err = store.InsertConversation(ctx, convo)
 	if err != nil {
-		panic(err.Error())
+		return common.StoreError(err, "conversation")
+	}
+	if unanswerable != nil {
+		common.RecordUnanswered(ctx, store, convo, req.Question, unanswerable)
 	}
 
 	response := postResponse{
-		Answer:         agentResponse,
-		ConversationId: res3.InsertedID.(primitive.ObjectID),
+		Answer:         turn.Content,
+		Sources:        turn.Sources,
+		ConversationId: convo.Id,
+		Turn:           turn,
+		Answerable:     unanswerable == nil,
 		Success:        true,
 	}
 
 	log.Output(1, "done")
 
+	if stream != nil {
+		return stream.Send("done", response)
+	}
+
 	// send the response
 	(*w).Header().Set("Content-Type", "application/json")
-	json.NewEncoder(*w).Encode(response)
+	return json.NewEncoder(*w).Encode(response)
 }
 
 func Handler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	if r.Method == "POST" {
-		handlePost(&w, r)
+	defer common.Recover(w)
+
+	var err error
+	switch r.Method {
+	case "POST":
+		err = handlePost(&w, r)
+	case "OPTIONS":
+		// nothing to do for CORS preflights
+	default:
+		err = common.MethodNotAllowedError(r.Method)
+	}
+	if err != nil {
+		common.WriteError(w, err)
 	}
 }
@@ -3,29 +3,29 @@ package scrape
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
-	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
   "path"
 
 	"github.com/gocolly/colly"
 	"github.com/passage-inc/chatassist/packages/vercel/common"
-	gogpt "github.com/sashabaranov/go-gpt3"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type pageChunk struct {
 	route string
 	text  string
-	index int // order encountered by Colly
-	level int // header level
+	index  int    // order encountered by Colly
+	level  int    // header level
+	anchor string // id of a header, so links can point at it
 }
 
 // this function from net/url must be included explicitly as Vercel does not have the
@@ -99,13 +99,21 @@ func parsePre(e *colly.HTMLElement) pageChunk {
 func parseHeader(e *colly.HTMLElement) pageChunk {
 	level, _ := strconv.Atoi(strings.TrimLeft(e.Name, "h"))
 
+	// the id sits either on the header itself or on an anchor inside of it
+	anchor := e.Attr("id")
+	if anchor == "" {
+		anchor = e.DOM.Find("[id]").First().AttrOr("id", "")
+	}
+
 	return pageChunk{
-		text:  strings.TrimSpace(e.DOM.Text()),
-		level: level,
+		text:   strings.TrimSpace(e.DOM.Text()),
+		level:  level,
+		anchor: anchor,
 	}
 }
 
-const MAX_SECTION_PSEUDO_TOKENS = 600
+// sections are split once they grow past this many tokens
+const MAX_SECTION_TOKENS = 800
 
 func processPage(a []pageChunk) common.Page {
 	// create temp array for mapping operations
@@ -151,21 +159,23 @@ func processPage(a []pageChunk) common.Page {
 			ptr += 1
 			sections = append(sections, common.Section{
 				Title:     v.text,
+				Anchor:    v.anchor,
 				Content:   "",
 				Embedding: []float64{},
 			})
-			runningTokenCt = common.CountPseudoTokens(v.text)
-		} else if runningTokenCt > MAX_SECTION_PSEUDO_TOKENS {
+			runningTokenCt = common.CountTokens(v.text)
+		} else if runningTokenCt > MAX_SECTION_TOKENS {
 			ptr += 1
 			sections = append(sections, common.Section{
 				Title:     sections[ptr-1].Title + " CONTINUED",
+				Anchor:    sections[ptr-1].Anchor,
 				Content:   v.text,
 				Embedding: []float64{},
 			})
-			runningTokenCt = common.CountPseudoTokens(v.text)
+			runningTokenCt = common.CountTokens(v.text)
 		} else {
 			sections[ptr].Content += "\n\n" + v.text
-			runningTokenCt += common.CountPseudoTokens(v.text)
+			runningTokenCt += common.CountTokens(v.text)
 		}
 	}
 	sections = sections[1:]
@@ -174,6 +184,7 @@ func processPage(a []pageChunk) common.Page {
 	nonEmptySections := make([]common.Section, 0, len(sections))
 	for _, v := range sections {
 		if len(v.Content) > 0 {
+			v.Terms = common.CountTerms(v.Zip())
 			nonEmptySections = append(nonEmptySections, v)
 		}
 	}
@@ -194,7 +205,49 @@ func processPage(a []pageChunk) common.Page {
 const SCRAPER_PARALLELISM = 8
 const MAX_CHUNKS_ARBITRARY = 4000
 
-func scrape(entry string, depth int) []common.Page {
+// how the scraper discovers pages: by following links from the entry url, by
+// seeding the frontier from the site's sitemaps, or both
+const (
+	SCRAPE_MODE_LINKS   = "links"
+	SCRAPE_MODE_SITEMAP = "sitemap"
+	SCRAPE_MODE_BOTH    = "both"
+)
+
+// the share of sections that may fail to embed before a scrape is considered broken
+const MAX_EMBEDDING_FAILURE_RATIO = 0.2
+
+type scrapeResult struct {
+	pages     []common.Page
+	skipped   []string // urls we were not allowed to visit by robots.txt
+	seeded    int      // urls taken from sitemaps
+	unchanged int      // pages carried over from the previous crawl
+}
+
+// sitemaps list the whole host, so only seed pages that live under the entry url
+func inScope(entry *url.URL, link *url.URL) bool {
+	scope := entry.Path
+	if !strings.HasSuffix(scope, "/") {
+		scope = strings.TrimSuffix(path.Dir("/"+scope), "/") + "/"
+	}
+	return link.Hostname() == entry.Hostname() && strings.HasPrefix(link.Path, scope)
+}
+
+// uniqueLinks sorts links and drops the duplicates, as most pages link to the same
+// places more than once
+func uniqueLinks(links []string) []string {
+	sort.Strings(links)
+	res := make([]string, 0, len(links))
+	for i, v := range links {
+		if i == 0 || v != links[i-1] {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// scrape crawls entry. previous holds the pages of the last crawl by route, which are
+// requested conditionally and carried over as they were if they did not change
+func scrape(entry string, depth int, mode string, previous map[string]common.Page) scrapeResult {
 	u, _ := url.Parse(entry)
 	domain := u.Hostname()
 	// Create a Collector
@@ -202,20 +255,91 @@ func scrape(entry string, depth int) []common.Page {
 		colly.AllowedDomains(domain),
 		colly.Async(true),
 		colly.MaxDepth(depth),
+		colly.UserAgent(common.SCRAPER_USER_AGENT),
 	)
 
 	stream := make(chan pageChunk, SCRAPER_PARALLELISM)
 	hasHitLimit := false
 
+	// colly's own robots.txt support is switched off by Init and knows nothing about
+	// Crawl-delay, so we apply our own policy before every visit
+	robots := common.NewRobotsPolicy(common.SCRAPER_USER_AGENT)
+	var skippedMu sync.Mutex
+	skipped := make(map[string]bool)
+	isAllowed := func(link *url.URL) bool {
+		if robots.Allowed(link) {
+			return true
+		}
+		skippedMu.Lock()
+		skipped[link.String()] = true
+		skippedMu.Unlock()
+		return false
+	}
+
 	// have the scraper run on multiple goroutines, which are abstractions
-	// over threads
-	c.Limit(&colly.LimitRule{DomainGlob: "*", Parallelism: SCRAPER_PARALLELISM})
+	// over threads. A Crawl-delay means one request at a time, spaced out
+	limit := &colly.LimitRule{DomainGlob: "*", Parallelism: SCRAPER_PARALLELISM}
+	if delay := robots.CrawlDelay(u); delay > 0 {
+		log.Output(1, fmt.Sprintf("honoring crawl delay of %s for %s", delay, domain))
+		limit.Parallelism = 1
+		limit.Delay = delay
+	}
+	c.Limit(limit)
 	c.SetRequestTimeout(10 * time.Second)
 
+	// what this crawl saw of every page apart from its content, by route
+	var fetchedMu sync.Mutex
+	fetched := make(map[string]*common.Page)
+	unchanged := make(map[string]bool)
+	fetchedPage := func(route string) *common.Page {
+		page, ok := fetched[route]
+		if !ok {
+			page = &common.Page{Route: route}
+			fetched[route] = page
+		}
+		return page
+	}
+
+	// once the chunk limit is hit, drop whatever is still queued, including sitemap seeds
+	c.OnRequest(func(r *colly.Request) {
+		if hasHitLimit {
+			r.Abort()
+			return
+		}
+		// the server answers 304 if the page is the one we already have
+		if prev, ok := previous[r.URL.Path]; ok {
+			if prev.ETag != "" {
+				r.Headers.Set("If-None-Match", prev.ETag)
+			}
+			if prev.LastModified != "" {
+				r.Headers.Set("If-Modified-Since", prev.LastModified)
+			}
+		}
+	})
+
+	c.OnResponse(func(r *colly.Response) {
+		fetchedMu.Lock()
+		defer fetchedMu.Unlock()
+		page := fetchedPage(r.Request.URL.Path)
+		page.ETag = r.Headers.Get("ETag")
+		page.LastModified = r.Headers.Get("Last-Modified")
+		page.ContentHash = common.ContentHash(r.Body)
+	})
+
 	// Visit every link
 	c.OnHTML("a[href]", func(e *colly.HTMLElement) {
-		if !hasHitLimit {
-			e.Request.Visit(e.Attr("href"))
+		if mode != SCRAPE_MODE_SITEMAP && !hasHitLimit {
+			link, err := url.Parse(e.Request.AbsoluteURL(e.Attr("href")))
+			if err != nil || (link.Hostname() == domain && !isAllowed(link)) {
+				return
+			}
+			if link.Hostname() == domain {
+				fetchedMu.Lock()
+				page := fetchedPage(e.Request.URL.Path)
+				page.Links = append(page.Links, link.String())
+				fetchedMu.Unlock()
+			}
+			e.Request.Visit(link.String())
 			log.Output(1, "visit "+e.Attr("href"))
 		}
 	})
@@ -247,7 +371,24 @@ func scrape(entry string, depth int) []common.Page {
 	})
 
 	c.OnError(func(r *colly.Response, err error) {
-		fmt.Println("Request URL:", r.Request.URL, "failed with response:", r, "\nError:", err)
+		// an unchanged page has no body to follow links from, so the ones it had
+		// last time are followed instead
+		if r.StatusCode == http.StatusNotModified {
+			route := r.Request.URL.Path
+			fetchedMu.Lock()
+			unchanged[route] = true
+			fetchedMu.Unlock()
+			if mode != SCRAPE_MODE_SITEMAP && !hasHitLimit {
+				for _, v := range previous[route].Links {
+					link, err := url.Parse(v)
+					if err == nil && isAllowed(link) {
+						r.Request.Visit(v)
+					}
+				}
+			}
+			return
+		}
+		log.Output(1, fmt.Sprintf("request to %s failed with status %d: %s", r.Request.URL, r.StatusCode, err.Error()))
 	})
 
 	// make a map of string to array of strings
@@ -272,7 +413,24 @@ func scrape(entry string, depth int) []common.Page {
 	}()
 
 	// Visit a website
-	c.Visit(entry)
+	if isAllowed(u) {
+		c.Visit(entry)
+	}
+
+	// seed the frontier with pages that no link may lead to
+	seeded := 0
+	if mode != SCRAPE_MODE_LINKS {
+		for _, v := range common.DiscoverSitemapUrls(u, robots) {
+			link, err := url.Parse(v)
+			if err != nil || !inScope(u, link) || !isAllowed(link) {
+				continue
+			}
+			if c.Visit(link.String()) == nil {
+				seeded += 1
+			}
+		}
+		log.Output(1, fmt.Sprintf("seeded %d urls from sitemaps of %s", seeded, domain))
+	}
 
 	// wait for all scrapers to finish
 	c.Wait()
@@ -281,153 +439,553 @@ func scrape(entry string, depth int) []common.Page {
 	for len(stream) > 0 {
 	}
 
-	content := make([]common.Page, 0, len(chunk_map))
+	content := make([]common.Page, 0, len(chunk_map)+len(unchanged))
+	// pages that did not change are taken over from the previous crawl as they were,
+	// whether the server said so or their content hashes to the same
+	for k := range unchanged {
+		content = append(content, previous[k])
+	}
 	// process pages
 	numChunks := 0
 	for k, v := range chunk_map {
+		if unchanged[k] {
+			continue
+		}
+		meta := fetched[k]
+		if meta == nil {
+			meta = &common.Page{}
+		}
+		if prev, ok := previous[k]; ok && meta.ContentHash != "" && prev.ContentHash == meta.ContentHash {
+			unchanged[k] = true
+			prev.ETag = meta.ETag
+			prev.LastModified = meta.LastModified
+			content = append(content, prev)
+			continue
+		}
 		numChunks += len(v)
 		page := processPage(v)
 		page.Route = k
+		page.ETag = meta.ETag
+		page.LastModified = meta.LastModified
+		page.ContentHash = meta.ContentHash
+		page.Links = uniqueLinks(meta.Links)
 		content = append(content, page)
 	}
-	log.Output(1, fmt.Sprintf("parsed %d chunks", numChunks))
+	log.Output(1, fmt.Sprintf("parsed %d chunks, %d pages unchanged", numChunks, len(unchanged)))
 
-	return content
+	skippedUrls := make([]string, 0, len(skipped))
+	for k := range skipped {
+		skippedUrls = append(skippedUrls, k)
+	}
+	sort.Strings(skippedUrls)
+	log.Output(1, fmt.Sprintf("skipped %d urls disallowed by robots.txt", len(skippedUrls)))
+
+	return scrapeResult{
+		pages:     content,
+		skipped:   skippedUrls,
+		seeded:    seeded,
+		unchanged: len(unchanged),
+	}
 }
 
 const BLOCK_FACTOR = 10
-const EMBEDDING_MODEL = gogpt.AdaEmbeddingV2
 
-func summarize(content []common.Page) []common.Page {
+// summarize embeds every section of content in batches, reusing the embeddings in
+// reuse, by section hash, instead where it can. Sections whose batch could not be
+// embedded are dropped, as are the validators of their pages, and their number is
+// returned alongside the errors and the number of embeddings reused
+func summarize(content []common.Page, e common.Embedder, reuse map[string][]float64, progress func(done int)) ([]common.Page, common.EmbeddingReport, int, error) {
 	ctx := context.Background()
-	c := gogpt.NewClient(os.Getenv("OPENAI_API_KEY"))
 
 	items := make([]string, 0)
-
-	for _, v := range content {
-		for _, v := range v.Sections {
-			items = append(items, v.Zip())
+	reused := 0
+
+	for i := range content {
+		for j := range content[i].Sections {
+			sec := &content[i].Sections[j]
+			sec.Hash = common.ContentHash([]byte(sec.Zip()))
+			if embedding, ok := reuse[sec.Hash]; ok {
+				sec.Embedding = embedding
+				reused += 1
+			} else {
+				sec.Embedding = nil
+				items = append(items, sec.Zip())
+			}
 		}
 	}
 
-	req := gogpt.EmbeddingRequest{
-		Input: items,
-		Model: gogpt.AdaEmbeddingV2,
-	}
-	res, err := c.CreateEmbeddings(ctx, req)
+	// progress counts the reused sections as done from the start
+	report := common.EmbedInBatches(ctx, items, e.Embed, func(done int) {
+		progress(reused + done)
+	})
 
-	if err != nil {
-		panic(err)
+	if len(items) > 0 && report.Failed == len(items) {
+		return nil, report, reused, common.UpstreamError(errors.New(report.Errors[0]), "could not generate any embeddings")
 	}
 
 	k := 0
 	for i, page := range content {
-		for j, sec := range page.Sections {
-			sec.Embedding = res.Data[k].Embedding
-			page.Sections[j] = sec
-			k += 1
+		sections := make([]common.Section, 0, len(page.Sections))
+		for _, sec := range page.Sections {
+			if sec.Embedding == nil {
+				sec.Embedding = report.Embeddings[k]
+				k += 1
+			}
+			if len(sec.Embedding) > 0 {
+				sections = append(sections, sec)
+			}
+		}
+		// a page missing sections must not be taken over as unchanged by the next
+		// crawl, which would then never embed them again
+		if len(sections) < len(page.Sections) {
+			page.ETag = ""
+			page.LastModified = ""
+			page.ContentHash = ""
 		}
+		page.Sections = sections
 		// for indirection purposes
 		content[i] = page
 	}
 
-	return content
+	return content, report, reused, nil
 }
 
-func mongoUpload(domain common.Domain) {
-	db, disconnect := common.GetDb()
-	defer disconnect()
-	coll := db.Collection("ScrapedDomains")
-
-	// if the collection contains a document with the same domain.domain, replace it, otherwise add a new one
-	_, err := coll.ReplaceOne(
-		context.TODO(),
-		bson.M{"domain": domain.Domain},
-		domain,
-		options.Replace().SetUpsert(true),
-	)
+// previousPages loads the pages of the active snapshot of domain, with their
+// sections, by route. They are only of use if their embeddings were made by model,
+// so for any other model there are none
+func previousPages(store common.Store, domain string, model string) (map[string]common.Page, error) {
+	ctx := context.TODO()
+	res := make(map[string]common.Page)
+	active, err := store.GetDomain(ctx, domain)
+	if errors.Is(err, common.ErrNotFound) || (err == nil && active.EmbeddingModel != model) {
+		return res, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	pages, err := store.GetPages(ctx, active.Id)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	for _, v := range pages {
+		res[v.Route] = v
+	}
+	err = store.EachSection(ctx, active.Id, func(p common.Page, sec common.Section) error {
+		// snapshots from before sections were hashed get their hashes and terms here
+		if sec.Hash == "" {
+			sec.Hash = common.ContentHash([]byte(sec.Zip()))
+		}
+		if sec.Terms == nil {
+			sec.Terms = common.CountTerms(sec.Zip())
+		}
+		page := res[p.Route]
+		page.Sections = append(page.Sections, sec)
+		res[p.Route] = page
+		return nil
+	})
+	return res, err
+}
+
+// embeddingsByHash indexes the embeddings of the sections of pages by section hash
+func embeddingsByHash(pages map[string]common.Page) map[string][]float64 {
+	res := make(map[string][]float64)
+	for _, page := range pages {
+		for _, v := range page.Sections {
+			res[v.Hash] = v.Embedding
+		}
+	}
+	return res
 }
 
 type scrapeRequest struct {
 	Domain string `json:"domain"`
 	Depth  int    `json:"depth"`
+	Mode   string `json:"mode"` // one of links, sitemap or both. Defaults to both
 }
 
 type scrapeResponse struct {
-	Success          bool   `json:"success"`
-	Domain           string `json:"domain"`
-	Error            string `json:"error"`
-	ScrapedPageCount int    `json:"scraped_page_count"`
+	Success bool             `json:"success"`
+	Domain  string           `json:"domain"`
+	Job     common.ScrapeJob `json:"job"`
 }
 
-func Handler(w http.ResponseWriter, r *http.Request) {
-	// deal with cors for local dev reasons
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+// updateJob saves the changes made to job. Failing to is only logged, unless the job
+// was finished meanwhile, which is returned for the pipeline to stop
+func updateJob(store common.Store, job *common.ScrapeJob) error {
+	job.UpdatedAt = time.Now()
+	err := store.UpdateScrapeJob(context.TODO(), *job)
+	if errors.Is(err, common.ErrJobFinished) {
+		return err
+	}
+	if err != nil {
+		log.Output(1, "could not update scrape job "+job.Id.Hex()+": "+err.Error())
+	}
+	return nil
+}
 
-	if r.Method == "POST" {
-		var req scrapeRequest
-		// parse from request body
-		err := json.NewDecoder(r.Body).Decode(&req)
-		if err != nil {
-			panic(err.Error())
+// runJob runs the pipeline of job, marking the job failed if it does not make it through
+func runJob(store common.Store, job common.ScrapeJob) {
+	// the pipeline only updates the job between its steps, and a crawl alone can take
+	// far longer than common.JOB_STALE_AFTER
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(common.JOB_HEARTBEAT_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := store.TouchScrapeJob(context.TODO(), job.Id); err != nil {
+					log.Output(1, "could not update scrape job "+job.Id.Hex()+": "+err.Error())
+				}
+			}
+		}
+	}()
+
+	// there is no request left to take a panic down with it, so record it on the job
+	defer func() {
+		if r := recover(); r != nil {
+			log.Output(1, fmt.Sprintf("scrape job %s panicked: %v", job.Id.Hex(), r))
+			job.State = common.JOB_FAILED
+			job.Error = fmt.Sprint(r)
+			updateJob(store, &job)
 		}
+	}()
+
+	err := runPipeline(store, &job)
+	if errors.Is(err, common.ErrJobFinished) {
+		log.Output(1, fmt.Sprintf("scrape job %s was finished elsewhere, stopping it", job.Id.Hex()))
+	} else if err != nil {
+		log.Output(1, fmt.Sprintf("scrape job %s failed: %s", job.Id.Hex(), err.Error()))
+		job.State = common.JOB_FAILED
+		job.Error = err.Error()
+		updateJob(store, &job)
+	}
+}
+
+// how long Work waits before looking at an empty queue again
+const WORKER_POLL_INTERVAL = 5 * time.Second
 
-		siteUrl := req.Domain
-		siteUrl = strings.TrimSpace(siteUrl)
+// RunNextJob fails the jobs whose worker is gone, then claims the oldest queued job and
+// runs it, reporting whether there was one
+func RunNextJob() (bool, error) {
+	store, err := common.GetStore()
+	if err != nil {
+		return false, err
+	}
+	defer store.Close()
+
+	ctx := context.TODO()
+	stale, err := store.FailStaleScrapeJobs(ctx, time.Now().Add(-common.JOB_STALE_AFTER))
+	if err != nil {
+		return false, err
+	}
+	if stale > 0 {
+		log.Output(1, fmt.Sprintf("failed %d scrape jobs that stopped responding", stale))
+	}
 
-		// check if siteUrl is valid
-		_, err = url.ParseRequestURI(siteUrl)
+	job, err := store.ClaimScrapeJob(ctx)
+	if errors.Is(err, common.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	log.Output(1, fmt.Sprintf("running scrape job %s for %s", job.Id.Hex(), job.Domain))
+	runJob(store, job)
+	return true, nil
+}
+
+// Work runs the queued scrape jobs one at a time until ctx is done. A serverless
+// function is stopped as soon as it has answered, so the jobs POST /scrape queues are
+// run by a process of its own, see cmd/scrape_worker, or by the dev server
+func Work(ctx context.Context) {
+	for ctx.Err() == nil {
+		ran, err := RunNextJob()
 		if err != nil {
-			panic(err.Error())
+			log.Output(1, "could not run the next scrape job: "+err.Error())
 		}
+		if ran {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(WORKER_POLL_INTERVAL):
+		}
+	}
+}
 
-		log.Output(1, "scraping "+siteUrl)
-		content := scrape(siteUrl, req.Depth)
-		log.Output(1, fmt.Sprintf("scraped %d pages from %s", len(content), siteUrl))
+// uploadIndex stores an encoded index of a snapshot, dropping the snapshot if it fails,
+// as an indexed snapshot without its index would never be searched through it
+func uploadIndex(store common.Store, domain common.Domain, kind string, data []byte, err error) error {
+	if err == nil {
+		err = store.PutIndex(context.TODO(), domain.Id, kind, data)
+	}
+	if err != nil {
+		if err := store.DeleteSnapshot(context.TODO(), domain.Id); err != nil {
+			log.Output(1, "could not clean up snapshot "+domain.Id.Hex()+": "+err.Error())
+		}
+		return common.UpstreamError(err, "could not upload the "+kind+" index of "+domain.Domain)
+	}
+	return nil
+}
+
+// runPipeline crawls, embeds and uploads a domain, recording its progress on the job as it goes
+func runPipeline(store common.Store, job *common.ScrapeJob) error {
+	siteUrl := job.Domain
+
+	// decode query-encoded domain. Must be done due to the idiosyncracies of browsers and JS
+	encodedDomain, err := common.EncodeDomain(siteUrl)
+	if err != nil {
+		return common.ValidationError("invalid domain %q", siteUrl)
+	}
+	log.Output(1, fmt.Sprintf("encoded %s as %s", siteUrl, encodedDomain))
+
+	// what the last crawl found is only fetched and embedded again where it changed
+	model, err := common.GetEmbedder()
+	if err != nil {
+		return common.InternalError(err)
+	}
+	embedder := common.NewCachedEmbedder(model, store)
+	previous, err := previousPages(store, encodedDomain, embedder.Model())
+	if err != nil {
+		return common.UpstreamError(err, "could not load the previous crawl of "+encodedDomain)
+	}
+
+	job.State = common.JOB_CRAWLING
+	if err := updateJob(store, job); err != nil {
+		return err
+	}
+	log.Output(1, fmt.Sprintf("scraping %s using %s, %d pages known", siteUrl, job.Mode, len(previous)))
+	result := scrape(siteUrl, job.Depth, job.Mode, previous)
+	content := result.pages
+	log.Output(1, fmt.Sprintf("scraped %d pages from %s, %d unchanged", len(content), siteUrl, result.unchanged))
 
-		sections := 0
-		for _, v := range content {
-			sections += len(v.Sections)
+	sections := 0
+	for _, v := range content {
+		sections += len(v.Sections)
+	}
+
+	job.State = common.JOB_EMBEDDING
+	job.PageCount = len(content)
+	job.SectionCount = sections
+	job.SitemapUrlCount = result.seeded
+	job.SkippedUrls = result.skipped
+	job.UnchangedPageCount = result.unchanged
+	if err := updateJob(store, job); err != nil {
+		return err
+	}
+	log.Output(1, fmt.Sprintf("generating up to %d embeddings for %s with %s", sections, siteUrl, embedder.Model()))
+	content, report, reused, err := summarize(content, embedder, embeddingsByHash(previous), func(done int) {
+		job.EmbeddedCount = done
+		job.EmbeddingCacheHits, job.EmbeddingCacheMisses = embedder.Stats()
+		updateJob(store, job)
+	})
+	if err != nil {
+		return err
+	}
+	job.ReusedEmbeddingCount = reused
+	job.EmbeddingCacheHits, job.EmbeddingCacheMisses = embedder.Stats()
+	log.Output(1, fmt.Sprintf("generated embeddings for %s, %d reused, %d cached, %d embedded, %d failed",
+		siteUrl, reused, job.EmbeddingCacheHits, job.EmbeddingCacheMisses, report.Failed))
+
+	job.State = common.JOB_UPLOADING
+	job.EmbeddedCount = sections - report.Failed
+	job.FailedEmbeddingCount = report.Failed
+	job.EmbeddingErrors = report.Errors
+	if err := updateJob(store, job); err != nil {
+		return err
+	}
+
+	// a crawl that came back empty or mostly unembedded would only make the active
+	// snapshot worse, so it is never stored
+	if job.EmbeddedCount == 0 {
+		return fmt.Errorf("no sections of %s could be scraped and embedded", siteUrl)
+	}
+	if float64(report.Failed) > MAX_EMBEDDING_FAILURE_RATIO*float64(sections) {
+		return fmt.Errorf("%d of %d sections of %s could not be embedded", report.Failed, sections, siteUrl)
+	}
+
+	// big domains are searched through an index rather than compared to every section
+	index, err := common.BuildIndex(content, embedder.Dimension())
+	if err != nil {
+		return common.InternalError(err)
+	}
+	if index != nil {
+		log.Output(1, fmt.Sprintf("indexed %d sections of %s", index.Len(), encodedDomain))
+	}
+	// the lexical one is cheap enough to build for all of them
+	lexical := common.BuildBM25(content)
+
+	log.Output(1, fmt.Sprintf("uploading %s", encodedDomain))
+	// citations link to the scheme the pages were crawled over
+	entry, err := url.Parse(siteUrl)
+	if err != nil {
+		return common.ValidationError("invalid domain %q", siteUrl)
+	}
+	domain := common.Domain{
+		Domain:         encodedDomain,
+		Scheme:         entry.Scheme,
+		EmbeddingModel: embedder.Model(),
+		Indexed:        index != nil,
+		LexicalIndexed: true,
+		Pages:          content,
+	}
+	for _, v := range domain.Pages {
+		v.Print()
+	}
+	domain, err = store.InsertSnapshot(context.TODO(), domain)
+	if err != nil {
+		return common.UpstreamError(err, "could not upload "+domain.Domain)
+	}
+	if index != nil {
+		data, err := index.Encode()
+		if err := uploadIndex(store, domain, common.INDEX_HNSW, data, err); err != nil {
+			return err
 		}
+	}
+	data, err := lexical.Encode()
+	if err := uploadIndex(store, domain, common.INDEX_BM25, data, err); err != nil {
+		return err
+	}
+	job.SnapshotId = domain.Id
+	job.Version = domain.Version
+	log.Output(1, fmt.Sprintf("uploaded %s as version %d", encodedDomain, domain.Version))
+
+	// only now that the snapshot is complete does it replace the one being answered from
+	if err := store.ActivateSnapshot(context.TODO(), domain.Domain, domain.Id); err != nil {
+		return common.UpstreamError(err, "could not activate version "+fmt.Sprint(domain.Version))
+	}
+	if err := common.PruneSnapshots(context.TODO(), store, domain.Domain, common.SNAPSHOTS_KEPT); err != nil {
+		log.Output(1, fmt.Sprintf("could not prune the snapshots of %s: %s", domain.Domain, err.Error()))
+	}
+
+	job.State = common.JOB_DONE
+	updateJob(store, job)
+	return nil
+}
+
+// handlePost queues a scrape job and answers with its id straight away. The crawl
+// takes far longer than a request may, and is left to Work
+func handlePost(w http.ResponseWriter, r *http.Request) error {
+	var req scrapeRequest
+	// parse from request body
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return common.ValidationError("invalid request body: %s", err.Error())
+	}
 
-		log.Output(1, fmt.Sprintf("generating %d embeddings for %s", sections, siteUrl))
-		content = summarize(content)
-		log.Output(1, fmt.Sprintf("generated embeddings for %s", siteUrl))
+	siteUrl := req.Domain
+	siteUrl = strings.TrimSpace(siteUrl)
 
-		// decode query-encoded domain. Must be done due to the idiosyncracies of browsers and JS
-		parsed, err := url.Parse(req.Domain)
+	// check if siteUrl is valid
+	_, err = url.ParseRequestURI(siteUrl)
+	if err != nil {
+		return common.ValidationError("invalid domain %q", siteUrl)
+	}
+
+	mode := req.Mode
+	if mode == "" {
+		mode = SCRAPE_MODE_BOTH
+	}
+	if mode != SCRAPE_MODE_LINKS && mode != SCRAPE_MODE_SITEMAP && mode != SCRAPE_MODE_BOTH {
+		return common.ValidationError("invalid scrape mode %q", mode)
+	}
+
+	store, err := common.GetStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	now := time.Now()
+	job := common.ScrapeJob{
+		Domain:          siteUrl,
+		Depth:           req.Depth,
+		Mode:            mode,
+		State:           common.JOB_QUEUED,
+		SkippedUrls:     []string{},
+		EmbeddingErrors: []string{},
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	job, err = store.InsertScrapeJob(context.TODO(), job)
+	if err != nil {
+		return common.UpstreamError(err, "could not queue the scrape job")
+	}
+	log.Output(1, fmt.Sprintf("queued scrape job %s for %s", job.Id.Hex(), siteUrl))
+
+	res := scrapeResponse{
+		Success: true,
+		Domain:  req.Domain,
+		Job:     job,
+	}
+
+	// send res as json
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	return json.NewEncoder(w).Encode(res)
+}
+
+// handleGet reports the progress of the job in GET /scrape/{id}
+func handleGet(w http.ResponseWriter, r *http.Request) error {
+	rawId := common.RouteParam(r, "scrape", "id")
+	id, err := primitive.ObjectIDFromHex(rawId)
+	if err != nil {
+		return common.ValidationError("invalid job id %q", rawId)
+	}
+
+	store, err := common.GetStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	job, err := store.GetScrapeJob(context.TODO(), id)
+	if err != nil {
+		return common.StoreError(err, "scrape job "+rawId)
+	}
+	// without a worker looking at the queue, a job abandoned by its worker would
+	// stay running for as long as it is polled
+	if job.Running() && time.Since(job.UpdatedAt) > common.JOB_STALE_AFTER {
+		if _, err := store.FailStaleScrapeJobs(context.TODO(), time.Now().Add(-common.JOB_STALE_AFTER)); err != nil {
+			return common.StoreError(err, "scrape jobs")
+		}
+		job, err = store.GetScrapeJob(context.TODO(), id)
 		if err != nil {
-			panic(err)
+			return common.StoreError(err, "scrape job "+rawId)
 		}
-    encodedDomain := parsed.Host + parsed.Path
+	}
 
-    log.Output(1, fmt.Sprintf("encoded %s as %s", req.Domain, encodedDomain))
-		log.Output(1, fmt.Sprintf("uploading %s", encodedDomain))
-		domain := common.Domain{
-			Domain: encodedDomain,
-			Pages:  content,
-		}
-    for _, v := range domain.Pages {
-      v.Print()
-    }
-		mongoUpload(domain)
-		log.Output(1, fmt.Sprintf("uploaded %s", encodedDomain))
+	res := scrapeResponse{
+		Success: true,
+		Domain:  job.Domain,
+		Job:     job,
+	}
 
-		res := scrapeResponse{
-			Success:          true,
-			Domain:           req.Domain,
-			ScrapedPageCount: len(content),
-		}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res)
+}
 
-		// send res as json
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(res)
-	} else {
-		// send an error
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte("405 - Method Not Allowed"))
+func Handler(w http.ResponseWriter, r *http.Request) {
+	// polling a job works from any page, queueing one is for admins
+	common.AllowReads(w, r)
+	defer common.Recover(w)
+
+	var err error
+	switch r.Method {
+	case "POST":
+		err = common.RequireAdmin(r)
+		if err == nil {
+			err = handlePost(w, r)
+		}
+	case "GET":
+		err = handleGet(w, r)
+	default:
+		err = common.MethodNotAllowedError(r.Method)
+	}
+	if err != nil {
+		common.WriteError(w, err)
 	}
 }
@@ -0,0 +1,148 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/passage-inc/chatassist/packages/vercel/common"
+)
+
+// how many results a search returns unless it asks for a number, and at most
+const (
+	DEFAULT_SEARCH_LIMIT = 10
+	MAX_SEARCH_LIMIT     = 50
+)
+
+type searchResult struct {
+	Url        string             `json:"url"`
+	Route      string             `json:"route"`
+	Title      string             `json:"title"`
+	PageTitle  string             `json:"page_title"`
+	Snippet    string             `json:"snippet"`
+	Highlights []common.Highlight `json:"highlights"`
+	Score      float64            `json:"score"`
+	Similarity float64            `json:"similarity"`
+}
+
+type searchResponse struct {
+	Domain  string         `json:"domain"`
+	Version int            `json:"version"`
+	Mode    string         `json:"mode"`
+	Results []searchResult `json:"results"`
+	Success bool           `json:"success"`
+}
+
+// handleGet ranks the sections of the active snapshot of ?domain= against ?q= the
+// same way a conversation does. ?mode= overrides the retrieval mode of the domain,
+// to compare them
+func handleGet(w http.ResponseWriter, r *http.Request) error {
+	ctx := context.TODO()
+	params := r.URL.Query()
+
+	query := params.Get("q")
+	if query == "" {
+		return common.ValidationError("q is required")
+	}
+	domain, err := common.EncodeDomain(params.Get("domain"))
+	if err != nil || domain == "" {
+		return common.ValidationError("a valid domain is required")
+	}
+	limit := DEFAULT_SEARCH_LIMIT
+	if raw := params.Get("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > MAX_SEARCH_LIMIT {
+			return common.ValidationError("limit must be between 1 and %d", MAX_SEARCH_LIMIT)
+		}
+	}
+
+	store, err := common.GetStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	targetDomain, err := store.GetDomain(ctx, domain)
+	if errors.Is(err, common.ErrNotFound) {
+		return common.NotFoundError("domain %s has not been scraped", domain)
+	} else if err != nil {
+		return common.StoreError(err, "domain")
+	}
+
+	cfg, err := common.FindDomainConfig(ctx, store, domain)
+	if err != nil {
+		return err
+	}
+	settings := cfg.Retrieval
+	if mode := params.Get("mode"); mode != "" {
+		settings.Mode = mode
+	}
+	if err := settings.Validate(); err != nil {
+		return common.ValidationError(err.Error())
+	}
+	settings = settings.WithDefaults()
+
+	model, err := common.EmbedderForModel(targetDomain.EmbeddingModel)
+	if err != nil {
+		return common.InternalError(err)
+	}
+	embedder := common.NewCachedEmbedder(model, store)
+	embedding, err := common.GetEmbedding(embedder, query)
+	if err != nil {
+		return err
+	}
+	ranked, err := common.RankSections(ctx, store, embedder, targetDomain, settings, query, embedding)
+	if err != nil {
+		return err
+	}
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	log.Output(1, fmt.Sprintf("searched %s for %q, %d results", domain, query, len(ranked)))
+
+	res := searchResponse{
+		Domain:  targetDomain.Domain,
+		Version: targetDomain.Version,
+		Mode:    settings.Mode,
+		Results: make([]searchResult, len(ranked)),
+		Success: true,
+	}
+	for i, v := range ranked {
+		snippet, highlights := common.Snippet(v.Section.Content, query)
+		res.Results[i] = searchResult{
+			Url:        common.SectionUrl(targetDomain, v.Page.Route, v.Section),
+			Route:      v.Page.Route,
+			Title:      common.HeadingText(v.Section.Title),
+			PageTitle:  common.HeadingText(v.Page.Title),
+			Snippet:    snippet,
+			Highlights: highlights,
+			Score:      v.Score,
+			Similarity: v.Similarity,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res)
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	defer common.Recover(w)
+
+	var err error
+	switch r.Method {
+	case "GET":
+		err = handleGet(w, r)
+	case "OPTIONS":
+		// nothing to do for CORS preflights
+	default:
+		err = common.MethodNotAllowedError(r.Method)
+	}
+	if err != nil {
+		common.WriteError(w, err)
+	}
+}
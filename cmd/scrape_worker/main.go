@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/passage-inc/chatassist/packages/vercel/api/scrape"
+	"github.com/passage-inc/chatassist/packages/vercel/common"
+)
+
+// scrape_worker runs the scrape jobs queued through POST /scrape, which outlive the
+// functions that queue them. Nothing on Vercel runs them, so without a worker next to
+// the deployment, against the same STORE, jobs stay queued forever
+func main() {
+	// a file store is only shared within one process, and a worker of its own would
+	// overwrite the jobs and snapshots the API writes. The dev server runs them itself
+	if os.Getenv("STORE") == common.STORE_FILE {
+		log.Fatal("STORE=file cannot be shared with a separate worker, use the dev server or STORE=mongo")
+	}
+	log.Output(1, "waiting for scrape jobs")
+	scrape.Work(context.Background())
+}
@@ -0,0 +1,31 @@
+package common
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// RequireAdmin checks that r carries the ADMIN_TOKEN as a bearer token, for endpoints
+// that change what the chat answers or expose what every customer said. Without
+// ADMIN_TOKEN they are disabled
+func RequireAdmin(r *http.Request) error {
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		return UnavailableError("admin endpoints are disabled, as ADMIN_TOKEN is not set")
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		return UnauthorizedError("a valid admin token is required")
+	}
+	return nil
+}
+
+// AllowReads lets any page GET an endpoint from a browser. Requests that change
+// something are for admins, so they get no CORS headers and their preflights fail
+func AllowReads(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+}
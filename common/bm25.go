@@ -0,0 +1,147 @@
+package common
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// the usual BM25 parameters: how quickly repeating a term stops counting, and how
+// much longer sections are penalized
+const (
+	BM25_K1 = 1.2
+	BM25_B  = 0.75
+)
+
+// codes like ERR-4032, SKU_12-AB or v2.1.0 are split up by wordRe, so they are also
+// kept whole, to rank sections containing exactly them first
+var codeRe = regexp.MustCompile(`\w+(?:[-.:/]\w+)+`)
+
+// TermCount is how often a term occurs in a section. Sections keep a list of them
+// rather than a map, as terms may contain dots, which field names may not
+type TermCount struct {
+	Term  string `bson:"t"`
+	Count int    `bson:"c"`
+}
+
+// CountTerms counts the terms of text for lexical search, sorted by term
+func CountTerms(text string) []TermCount {
+	text = strings.ToLower(text)
+	counts := make(map[string]int)
+	for _, v := range wordRe.FindAllString(text, -1) {
+		counts[v] += 1
+	}
+	for _, v := range codeRe.FindAllString(text, -1) {
+		counts[v] += 1
+	}
+	res := make([]TermCount, 0, len(counts))
+	for k, v := range counts {
+		res = append(res, TermCount{Term: k, Count: v})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Term < res[j].Term
+	})
+	return res
+}
+
+type BM25Posting struct {
+	Doc  int32 // the position of the section in its snapshot
+	Freq int32
+}
+
+// BM25 is an inverted index over the sections of a snapshot, built alongside its
+// HNSW index but for every snapshot, whatever its size
+type BM25 struct {
+	Lengths   []int32 // the number of terms of every section
+	AvgLength float64
+	Postings  map[string][]BM25Posting
+}
+
+// BuildBM25 indexes the sections of pages, in the order they are stored in
+func BuildBM25(pages []Page) *BM25 {
+	index := &BM25{
+		Lengths:  make([]int32, 0),
+		Postings: make(map[string][]BM25Posting),
+	}
+	total := 0
+	for _, page := range pages {
+		for _, v := range page.Sections {
+			terms := v.Terms
+			if terms == nil {
+				// sections carried over from before terms were counted
+				terms = CountTerms(v.Zip())
+			}
+			doc := int32(len(index.Lengths))
+			length := 0
+			for _, t := range terms {
+				index.Postings[t.Term] = append(index.Postings[t.Term], BM25Posting{Doc: doc, Freq: int32(t.Count)})
+				length += t.Count
+			}
+			index.Lengths = append(index.Lengths, int32(length))
+			total += length
+		}
+	}
+	if len(index.Lengths) > 0 {
+		index.AvgLength = float64(total) / float64(len(index.Lengths))
+	}
+	return index
+}
+
+func (index *BM25) Len() int {
+	return len(index.Lengths)
+}
+
+// Search returns the k sections scoring best for query, best first, along with
+// their scores. Sections sharing no term with query are never returned
+func (index *BM25) Search(query string, k int) ([]int, []float64) {
+	n := float64(index.Len())
+	scores := make(map[int32]float64)
+	for _, t := range CountTerms(query) {
+		postings := index.Postings[t.Term]
+		if len(postings) == 0 {
+			continue
+		}
+		df := float64(len(postings))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for _, p := range postings {
+			tf := float64(p.Freq)
+			norm := 1 - BM25_B + BM25_B*float64(index.Lengths[p.Doc])/index.AvgLength
+			scores[p.Doc] += idf * tf * (BM25_K1 + 1) / (tf + BM25_K1*norm)
+		}
+	}
+
+	docs := make([]int, 0, len(scores))
+	for doc := range scores {
+		docs = append(docs, int(doc))
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		si, sj := scores[int32(docs[i])], scores[int32(docs[j])]
+		if si != sj {
+			return si > sj
+		}
+		return docs[i] < docs[j]
+	})
+	if len(docs) > k {
+		docs = docs[:k]
+	}
+	res := make([]float64, len(docs))
+	for i, v := range docs {
+		res[i] = scores[int32(v)]
+	}
+	return docs, res
+}
+
+func (index *BM25) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(index)
+	return buf.Bytes(), err
+}
+
+func DecodeBM25(data []byte) (*BM25, error) {
+	var index BM25
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&index)
+	return &index, err
+}
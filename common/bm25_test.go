@@ -0,0 +1,70 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func sectionsPage(route string, contents ...string) Page {
+	page := Page{Route: route}
+	for _, v := range contents {
+		page.Sections = append(page.Sections, Section{Content: v})
+	}
+	return page
+}
+
+func TestBM25Search(t *testing.T) {
+	index := BuildBM25([]Page{
+		sectionsPage("/shipping",
+			"We ship worldwide within five days.",
+			"Shipping is free for orders above fifty dollars."),
+		sectionsPage("/errors",
+			"Error ERR-4032 means the card was declined.",
+			"Error ERR-4033 means the card expired."),
+		sectionsPage("/returns",
+			"Returns are accepted within thirty days, returns of sale items are not."),
+	})
+	if index.Len() != 5 {
+		t.Fatalf("Len() = %d, want 5", index.Len())
+	}
+	tests := []struct {
+		query string
+		k     int
+		want  []int
+	}{
+		{"shipping", 10, []int{1}},
+		{"SHIPPING costs", 10, []int{1}},
+		{"ERR-4032", 10, []int{2, 3}},
+		{"card declined", 10, []int{2, 3}},
+		{"returns", 10, []int{4}},
+		{"ship returns card", 2, []int{4, 0}},
+		{"nothing matches", 10, []int{}},
+		{"", 10, []int{}},
+	}
+	for _, tt := range tests {
+		got, scores := index.Search(tt.query, tt.k)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Search(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+		for i := 1; i < len(scores); i++ {
+			if scores[i] > scores[i-1] {
+				t.Errorf("Search(%q) scores are not sorted: %v", tt.query, scores)
+			}
+		}
+	}
+}
+
+func TestBM25Encode(t *testing.T) {
+	index := BuildBM25([]Page{sectionsPage("/", "hello world", "hello again")})
+	data, err := index.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeBM25(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, index) {
+		t.Errorf("DecodeBM25 = %+v, want %+v", decoded, index)
+	}
+}
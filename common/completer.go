@@ -0,0 +1,276 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	ROLE_SYSTEM    = "system"
+	ROLE_USER      = "user"
+	ROLE_ASSISTANT = "assistant"
+)
+
+type ChatMessage struct {
+	Role    string `json:"role" bson:"role"`
+	Content string `json:"content" bson:"content"`
+}
+
+// CompletionSettings pick the model and sampling parameters of a completion. Unset
+// fields fall back to DEFAULT_COMPLETION_SETTINGS; pointers tell an unset
+// temperature apart from a temperature of zero
+type CompletionSettings struct {
+	Model       string   `json:"model,omitempty" bson:"model,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty" bson:"max_tokens,omitempty"`
+	Temperature *float32 `json:"temperature,omitempty" bson:"temperature,omitempty"`
+	TopP        *float32 `json:"top_p,omitempty" bson:"top_p,omitempty"`
+}
+
+var defaultTemperature float32 = 0.7
+var defaultTopP float32 = 1
+
+var DEFAULT_COMPLETION_SETTINGS = CompletionSettings{
+	Model:       "gpt-3.5-turbo",
+	MaxTokens:   256,
+	Temperature: &defaultTemperature,
+	TopP:        &defaultTopP,
+}
+
+func (s CompletionSettings) WithDefaults() CompletionSettings {
+	if s.Model == "" {
+		s.Model = DEFAULT_COMPLETION_SETTINGS.Model
+	}
+	if s.MaxTokens == 0 {
+		s.MaxTokens = DEFAULT_COMPLETION_SETTINGS.MaxTokens
+	}
+	if s.Temperature == nil {
+		s.Temperature = DEFAULT_COMPLETION_SETTINGS.Temperature
+	}
+	if s.TopP == nil {
+		s.TopP = DEFAULT_COMPLETION_SETTINGS.TopP
+	}
+	return s
+}
+
+// Completion is a whole answer, along with the model that made it and what it cost
+type Completion struct {
+	Content string
+	Model   string
+	Usage   TokenUsage
+}
+
+// Completer continues a chat given as a list of role-tagged messages. Stream does
+// the same but hands every piece of the answer to onDelta as soon as it arrives;
+// an error from onDelta aborts the stream. Both return the whole answer
+type Completer interface {
+	Complete(ctx context.Context, messages []ChatMessage, settings CompletionSettings) (Completion, error)
+	Stream(ctx context.Context, messages []ChatMessage, settings CompletionSettings, onDelta func(delta string) error) (Completion, error)
+}
+
+const DEFAULT_OPENAI_BASE_URL = "https://api.openai.com/v1"
+
+// GetCompleter returns a completer for the OpenAI-compatible server at OPENAI_BASE_URL,
+// which defaults to OpenAI itself. Point it at a local stand-in or a self-hosted
+// model to run without OpenAI
+func GetCompleter() Completer {
+	baseUrl := os.Getenv("OPENAI_BASE_URL")
+	if baseUrl == "" {
+		baseUrl = DEFAULT_OPENAI_BASE_URL
+	}
+	return NewOpenAICompleter(baseUrl, os.Getenv("OPENAI_API_KEY"))
+}
+
+// OpenAICompleter talks to any server implementing OpenAI's /chat/completions
+type OpenAICompleter struct {
+	baseUrl string
+	apiKey  string
+	client  *http.Client
+}
+
+func NewOpenAICompleter(baseUrl string, apiKey string) *OpenAICompleter {
+	return &OpenAICompleter{
+		baseUrl: strings.TrimSuffix(baseUrl, "/"),
+		apiKey:  apiKey,
+		client:  &http.Client{Timeout: time.Minute},
+	}
+}
+
+// CompletionHTTPError is a non 2xx answer from an OpenAI-compatible server
+type CompletionHTTPError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *CompletionHTTPError) Error() string {
+	return fmt.Sprintf("error, status code: %d, message: %s", e.StatusCode, e.Message)
+}
+
+type chatCompletionRequest struct {
+	Model       string        `json:"model"`
+	Messages    []ChatMessage `json:"messages"`
+	MaxTokens   int           `json:"max_tokens"`
+	Temperature float32       `json:"temperature"`
+	TopP        float32       `json:"top_p"`
+	Stream      bool          `json:"stream,omitempty"`
+	// asks for the usage of a streamed completion, which is not sent otherwise
+	StreamOptions *streamOptions `json:"stream_options,omitempty"`
+}
+
+type streamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type chatCompletionResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message ChatMessage `json:"message"`
+	} `json:"choices"`
+	Usage *TokenUsage `json:"usage"`
+}
+
+type chatCompletionChunk struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Delta ChatMessage `json:"delta"`
+	} `json:"choices"`
+	Usage *TokenUsage `json:"usage"`
+}
+
+type errorResponse struct {
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (c *OpenAICompleter) post(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseUrl+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		defer res.Body.Close()
+		httpErr := &CompletionHTTPError{StatusCode: res.StatusCode, Message: http.StatusText(res.StatusCode)}
+		var errRes errorResponse
+		if json.NewDecoder(res.Body).Decode(&errRes) == nil && errRes.Error != nil {
+			httpErr.Message = errRes.Error.Message
+		}
+		return nil, httpErr
+	}
+	return res, nil
+}
+
+func newChatCompletionRequest(messages []ChatMessage, settings CompletionSettings) chatCompletionRequest {
+	settings = settings.WithDefaults()
+	return chatCompletionRequest{
+		Model:       settings.Model,
+		Messages:    messages,
+		MaxTokens:   settings.MaxTokens,
+		Temperature: *settings.Temperature,
+		TopP:        *settings.TopP,
+	}
+}
+
+// newCompletion fills in what the server left out of its response: the model is the
+// one requested, and the usage is counted
+func newCompletion(req chatCompletionRequest, content string, model string, usage *TokenUsage) Completion {
+	res := Completion{Content: content, Model: model}
+	if res.Model == "" {
+		res.Model = req.Model
+	}
+	if usage != nil {
+		res.Usage = *usage
+		return res
+	}
+	for _, v := range req.Messages {
+		res.Usage.PromptTokens += CountTokens(v.Content)
+	}
+	res.Usage.CompletionTokens = CountTokens(content)
+	res.Usage.TotalTokens = res.Usage.PromptTokens + res.Usage.CompletionTokens
+	res.Usage.Estimated = true
+	return res
+}
+
+func (c *OpenAICompleter) Complete(ctx context.Context, messages []ChatMessage, settings CompletionSettings) (Completion, error) {
+	req := newChatCompletionRequest(messages, settings)
+	res, err := c.post(ctx, "/chat/completions", req)
+	if err != nil {
+		return Completion{}, err
+	}
+	defer res.Body.Close()
+
+	var completion chatCompletionResponse
+	if err := json.NewDecoder(res.Body).Decode(&completion); err != nil {
+		return Completion{}, err
+	}
+	if len(completion.Choices) == 0 {
+		return Completion{}, fmt.Errorf("completion returned no choices")
+	}
+	return newCompletion(req, completion.Choices[0].Message.Content, completion.Model, completion.Usage), nil
+}
+
+// Stream reads the server-sent events of a streamed completion, one chunk per data line.
+// The usage comes in a chunk of its own, after the last delta, from servers that
+// support stream_options
+func (c *OpenAICompleter) Stream(ctx context.Context, messages []ChatMessage, settings CompletionSettings, onDelta func(delta string) error) (Completion, error) {
+	req := newChatCompletionRequest(messages, settings)
+	req.Stream = true
+	req.StreamOptions = &streamOptions{IncludeUsage: true}
+	res, err := c.post(ctx, "/chat/completions", req)
+	if err != nil {
+		return Completion{}, err
+	}
+	defer res.Body.Close()
+
+	var answer strings.Builder
+	var model string
+	var usage *TokenUsage
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+		var chunk chatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return newCompletion(req, answer.String(), model, usage), err
+		}
+		if chunk.Model != "" {
+			model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		delta := chunk.Choices[0].Delta.Content
+		answer.WriteString(delta)
+		if err := onDelta(delta); err != nil {
+			return newCompletion(req, answer.String(), model, usage), err
+		}
+	}
+	return newCompletion(req, answer.String(), model, usage), scanner.Err()
+}
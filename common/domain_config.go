@@ -0,0 +1,160 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	OUTPUT_FORMAT_PLAIN    = "plain"
+	OUTPUT_FORMAT_MARKDOWN = "markdown"
+)
+
+// DomainConfig is how the assistant of a scraped domain presents itself. It is kept
+// in its own collection, keyed by domain, so that re-scraping leaves it untouched
+type DomainConfig struct {
+	Id     primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Domain string             `bson:"domain" json:"domain"`
+
+	AssistantName string `bson:"assistant_name" json:"assistant_name"`
+	// a text/template rendered with a PromptData, see DEFAULT_SYSTEM_PROMPT
+	SystemPrompt      string `bson:"system_prompt" json:"system_prompt"`
+	EscalationContact string `bson:"escalation_contact" json:"escalation_contact"`
+	Greeting          string `bson:"greeting" json:"greeting"`
+	OutputFormat      string `bson:"output_format" json:"output_format"`
+	RefusalText       string `bson:"refusal_text" json:"refusal_text"`
+	// the answer to questions there is no relevant content for, see UnansweredAnswer
+	UnansweredText string `bson:"unanswered_text" json:"unanswered_text"`
+
+	Completion CompletionSettings `bson:"completion" json:"completion"`
+	Retrieval  RetrievalSettings  `bson:"retrieval" json:"retrieval"`
+}
+
+const DEFAULT_SYSTEM_PROMPT = "You are {{.AssistantName}}, a chatbot customer support agent for {{.Domain}}, and should continue the conversation in a cordial and professional manner using the information provided above alone to guide your responses. " +
+	"If you don't know the answer or the information is not provided above, {{if .EscalationContact}}refer the customer to {{.EscalationContact}}{{else}}tell the customer you don't know{{end}}. " +
+	"Do not go off-topic or talk about irrelevant things--you are a customer service chatbot." +
+	"{{if .RefusalText}} When asked about anything else, reply with: {{.RefusalText}}{{end}}"
+
+// PromptData is what a system prompt template can refer to. It is kept apart from the
+// config, whose methods a template could otherwise call, render prompts included
+type PromptData struct {
+	AssistantName     string
+	Domain            string
+	EscalationContact string
+	RefusalText       string
+}
+
+var DEFAULT_DOMAIN_CONFIG = DomainConfig{
+	AssistantName:  "Support Assistant",
+	SystemPrompt:   DEFAULT_SYSTEM_PROMPT,
+	Greeting:       "Hello! What can I do for you today?",
+	OutputFormat:   OUTPUT_FORMAT_PLAIN,
+	UnansweredText: "I'm sorry, I couldn't find anything about that.",
+}
+
+// EncodeDomain turns a url as sent by browsers into the key domains are stored under
+func EncodeDomain(raw string) (string, error) {
+	parsed, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", err
+	}
+	return parsed.Host + parsed.Path, nil
+}
+
+func (cfg DomainConfig) WithDefaults() DomainConfig {
+	if cfg.AssistantName == "" {
+		cfg.AssistantName = DEFAULT_DOMAIN_CONFIG.AssistantName
+	}
+	if cfg.SystemPrompt == "" {
+		cfg.SystemPrompt = DEFAULT_DOMAIN_CONFIG.SystemPrompt
+	}
+	if cfg.Greeting == "" {
+		cfg.Greeting = DEFAULT_DOMAIN_CONFIG.Greeting
+	}
+	if cfg.OutputFormat == "" {
+		cfg.OutputFormat = DEFAULT_DOMAIN_CONFIG.OutputFormat
+	}
+	if cfg.UnansweredText == "" {
+		cfg.UnansweredText = DEFAULT_DOMAIN_CONFIG.UnansweredText
+	}
+	return cfg
+}
+
+// Validate checks the fields a client may have gotten wrong
+func (cfg DomainConfig) Validate() error {
+	if cfg.Domain == "" {
+		return fmt.Errorf("domain is required")
+	}
+	if cfg.OutputFormat != "" && cfg.OutputFormat != OUTPUT_FORMAT_PLAIN && cfg.OutputFormat != OUTPUT_FORMAT_MARKDOWN {
+		return fmt.Errorf("output_format must be %s or %s", OUTPUT_FORMAT_PLAIN, OUTPUT_FORMAT_MARKDOWN)
+	}
+	if err := cfg.Retrieval.Validate(); err != nil {
+		return err
+	}
+	// rendering it once catches what parsing alone does not, like unknown fields
+	if _, err := cfg.WithDefaults().renderTemplate(); err != nil {
+		return fmt.Errorf("invalid system_prompt: %w", err)
+	}
+	return nil
+}
+
+func (cfg DomainConfig) renderTemplate() (string, error) {
+	tmpl, err := template.New("system_prompt").Parse(cfg.SystemPrompt)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	err = tmpl.Execute(&sb, PromptData{
+		AssistantName:     cfg.AssistantName,
+		Domain:            cfg.Domain,
+		EscalationContact: cfg.EscalationContact,
+		RefusalText:       cfg.RefusalText,
+	})
+	return sb.String(), err
+}
+
+// RenderSystemPrompt fills in the system prompt template and appends the
+// instructions for the allowed output format
+func (cfg DomainConfig) RenderSystemPrompt() (string, error) {
+	cfg = cfg.WithDefaults()
+	prompt, err := cfg.renderTemplate()
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	sb.WriteString(prompt)
+	if cfg.OutputFormat == OUTPUT_FORMAT_MARKDOWN {
+		sb.WriteString(" Format your answer using markdown where it helps readability.")
+	} else {
+		sb.WriteString(" Do not output an answer containing any markdown syntax.")
+	}
+	return sb.String(), nil
+}
+
+// UnansweredAnswer is what the assistant says when it has no content to answer from,
+// instead of asking the completer
+func (cfg DomainConfig) UnansweredAnswer() string {
+	cfg = cfg.WithDefaults()
+	if cfg.EscalationContact != "" {
+		return cfg.UnansweredText + " Please contact " + cfg.EscalationContact + "."
+	}
+	return cfg.UnansweredText
+}
+
+// FindDomainConfig returns the configuration of domain, or the defaults if it has none
+func FindDomainConfig(ctx context.Context, store Store, domain string) (DomainConfig, error) {
+	cfg, err := store.GetDomainConfig(ctx, domain)
+	if errors.Is(err, ErrNotFound) {
+		cfg, err = DomainConfig{Domain: domain}, nil
+	}
+	if err != nil {
+		return cfg, UpstreamError(err, "could not load the domain config")
+	}
+	return cfg.WithDefaults(), nil
+}
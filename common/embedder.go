@@ -0,0 +1,154 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+
+	gogpt "github.com/sashabaranov/go-gpt3"
+)
+
+// Embedder turns text into vectors. Every vector an Embedder returns has Dimension()
+// entries, and vectors from different models must never be compared
+type Embedder interface {
+	Model() string
+	Dimension() int
+	Embed(ctx context.Context, inputs []string) ([][]float64, error)
+}
+
+const OPENAI_EMBEDDING_LEN = 1536
+
+// the offline embedder. Bump the version whenever its output changes, as domains
+// embedded with the old one would no longer be comparable
+const LOCAL_EMBEDDING_MODEL = "local-hashing-v1"
+const LOCAL_EMBEDDING_LEN = 512
+
+// EmbedderForModel returns the embedder producing vectors for model. Domains remember
+// the model they were embedded with, so questions about them are embedded alike.
+// An empty model means the OpenAI default, which is what older domains used. Any
+// other model this build has no embedder for is an error, as vectors of another
+// model would be meaningless next to the domain's
+func EmbedderForModel(model string) (Embedder, error) {
+	switch model {
+	case LOCAL_EMBEDDING_MODEL:
+		return NewHashingEmbedder(LOCAL_EMBEDDING_LEN), nil
+	case "", gogpt.AdaEmbeddingV2.String():
+		return NewOpenAIEmbedder(os.Getenv("OPENAI_API_KEY")), nil
+	default:
+		return nil, fmt.Errorf("unknown embedding model %q", model)
+	}
+}
+
+// GetEmbedder returns the embedder new scrapes should use, as set by EMBEDDING_MODEL
+func GetEmbedder() (Embedder, error) {
+	return EmbedderForModel(os.Getenv("EMBEDDING_MODEL"))
+}
+
+type OpenAIEmbedder struct {
+	client *gogpt.Client
+	model  gogpt.EmbeddingModel
+}
+
+func NewOpenAIEmbedder(apiKey string) *OpenAIEmbedder {
+	return &OpenAIEmbedder{
+		client: gogpt.NewClient(apiKey),
+		model:  gogpt.AdaEmbeddingV2,
+	}
+}
+
+func (e *OpenAIEmbedder) Model() string {
+	return e.model.String()
+}
+
+func (e *OpenAIEmbedder) Dimension() int {
+	return OPENAI_EMBEDDING_LEN
+}
+
+func (e *OpenAIEmbedder) Embed(ctx context.Context, inputs []string) ([][]float64, error) {
+	req := gogpt.EmbeddingRequest{
+		Input: inputs,
+		Model: e.model,
+	}
+	res, err := e.client.CreateEmbeddings(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	embeddings := make([][]float64, len(inputs))
+	for _, v := range res.Data {
+		if v.Index < len(embeddings) {
+			embeddings[v.Index] = v.Embedding
+		}
+	}
+	return embeddings, nil
+}
+
+// HashingEmbedder embeds text without any network access by hashing its words and
+// word pairs into a fixed number of buckets, weighted by log term frequency. Texts
+// sharing vocabulary end up close together, which is all retrieval needs in tests
+// and air-gapped demos
+type HashingEmbedder struct {
+	dimension int
+}
+
+func NewHashingEmbedder(dimension int) *HashingEmbedder {
+	return &HashingEmbedder{dimension: dimension}
+}
+
+func (e *HashingEmbedder) Model() string {
+	return LOCAL_EMBEDDING_MODEL
+}
+
+func (e *HashingEmbedder) Dimension() int {
+	return e.dimension
+}
+
+var wordRe = regexp.MustCompile(`\w+`)
+
+func (e *HashingEmbedder) embedOne(text string) []float64 {
+	words := wordRe.FindAllString(strings.ToLower(text), -1)
+	counts := make(map[string]int)
+	for i, v := range words {
+		counts[v] += 1
+		if i > 0 {
+			counts[words[i-1]+" "+v] += 1
+		}
+	}
+
+	vec := make([]float64, e.dimension)
+	for term, n := range counts {
+		h := fnv.New64a()
+		h.Write([]byte(term))
+		sum := h.Sum64()
+		// the top bit picks the sign so that colliding terms tend to cancel out
+		sign := 1.0
+		if sum>>63 == 1 {
+			sign = -1.0
+		}
+		vec[sum%uint64(e.dimension)] += sign * (1 + math.Log(float64(n)))
+	}
+
+	// normalize so that dot products are cosine similarities, like OpenAI's
+	norm := 0.0
+	for _, v := range vec {
+		norm += v * v
+	}
+	if norm > 0 {
+		norm = math.Sqrt(norm)
+		for i := range vec {
+			vec[i] /= norm
+		}
+	}
+	return vec
+}
+
+func (e *HashingEmbedder) Embed(ctx context.Context, inputs []string) ([][]float64, error) {
+	embeddings := make([][]float64, len(inputs))
+	for i, v := range inputs {
+		embeddings[i] = e.embedOne(v)
+	}
+	return embeddings, nil
+}
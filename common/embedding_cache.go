@@ -0,0 +1,98 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// CachedEmbedder embeds through another Embedder, remembering every embedding in the
+// store by model and input hash, so text seen before never reaches the provider again
+type CachedEmbedder struct {
+	Embedder
+	store Store
+
+	mu     sync.Mutex
+	hits   int
+	misses int
+	// the hashes of the inputs counted already, so that retries are not counted again
+	counted map[string]bool
+}
+
+func NewCachedEmbedder(e Embedder, store Store) *CachedEmbedder {
+	return &CachedEmbedder{Embedder: e, store: store, counted: map[string]bool{}}
+}
+
+func (e *CachedEmbedder) Embed(ctx context.Context, inputs []string) ([][]float64, error) {
+	hashes := make([]string, len(inputs))
+	for i, v := range inputs {
+		hashes[i] = ContentHash([]byte(v))
+	}
+
+	// the cache is only ever an optimization, so a failing one counts as empty
+	cached, err := e.store.GetEmbeddings(ctx, e.Model(), hashes)
+	if err != nil {
+		log.Output(1, "could not read the embedding cache: "+err.Error())
+		cached = map[string][]float64{}
+	}
+
+	// identical inputs within the call are only embedded once
+	missing := make([]string, 0)
+	missingIdx := make(map[string]int)
+	for i, v := range hashes {
+		if _, ok := cached[v]; ok {
+			continue
+		}
+		if _, ok := missingIdx[v]; !ok {
+			missingIdx[v] = len(missing)
+			missing = append(missing, inputs[i])
+		}
+	}
+	e.mu.Lock()
+	for _, v := range hashes {
+		if e.counted[v] {
+			continue
+		}
+		e.counted[v] = true
+		if _, ok := cached[v]; ok {
+			e.hits += 1
+		} else {
+			e.misses += 1
+		}
+	}
+	e.mu.Unlock()
+
+	if len(missing) > 0 {
+		res, err := e.Embedder.Embed(ctx, missing)
+		if err != nil {
+			return nil, err
+		}
+		if len(res) != len(missing) {
+			return nil, fmt.Errorf("expected %d embeddings, got %d", len(missing), len(res))
+		}
+		fresh := make(map[string][]float64, len(missing))
+		for k, i := range missingIdx {
+			if res[i] != nil {
+				fresh[k] = res[i]
+				cached[k] = res[i]
+			}
+		}
+		if err := e.store.PutEmbeddings(ctx, e.Model(), fresh); err != nil {
+			log.Output(1, "could not write the embedding cache: "+err.Error())
+		}
+	}
+
+	embeddings := make([][]float64, len(inputs))
+	for i, v := range hashes {
+		embeddings[i] = cached[v]
+	}
+	return embeddings, nil
+}
+
+// Stats returns how many distinct inputs were found in the cache and how many were not
+func (e *CachedEmbedder) Stats() (hits int, misses int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.hits, e.misses
+}
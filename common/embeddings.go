@@ -0,0 +1,173 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// limits on a single embedding request, and how many requests may be in flight at once
+const EMBEDDING_BATCH_SIZE = 256
+const EMBEDDING_BATCH_TOKENS = 8000
+const EMBEDDING_WORKERS = 4
+
+// a failed batch is retried this many times, waiting twice as long each time
+const EMBEDDING_MAX_RETRIES = 5
+const EMBEDDING_RETRY_BASE_DELAY = time.Second
+
+// EmbedFunc embeds one batch of inputs, returning one vector per input in order
+type EmbedFunc func(ctx context.Context, inputs []string) ([][]float64, error)
+
+// EmbeddingReport is the outcome of EmbedInBatches. Embeddings[i] is empty when the
+// batch holding inputs[i] kept failing, or its embedding was missing from the answer
+type EmbeddingReport struct {
+	Embeddings [][]float64
+	Failed     int
+	Errors     []string
+}
+
+type embeddingBatch struct {
+	start int
+	end   int
+}
+
+// batchInputs cuts inputs into consecutive batches holding at most maxItems inputs
+// and maxTokens tokens. An input above maxTokens on its own gets its own batch
+func batchInputs(inputs []string, maxItems int, maxTokens int) []embeddingBatch {
+	batches := make([]embeddingBatch, 0)
+	start := 0
+	tokens := 0
+	for i, v := range inputs {
+		n := CountTokens(v)
+		if i > start && (i-start >= maxItems || tokens+n > maxTokens) {
+			batches = append(batches, embeddingBatch{start: start, end: i})
+			start = i
+			tokens = 0
+		}
+		tokens += n
+	}
+	if start < len(inputs) {
+		batches = append(batches, embeddingBatch{start: start, end: len(inputs)})
+	}
+	return batches
+}
+
+var statusCodeRe = regexp.MustCompile(`status code: (\d+)`)
+
+// isRetryable reports whether err is worth another attempt: rate limits, server
+// errors and requests that never got an answer
+func isRetryable(err error) bool {
+	var httpErr *CompletionHTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == 429 || httpErr.StatusCode >= 500
+	}
+	// go-gpt3 only reports the status code in its error message
+	if m := statusCodeRe.FindStringSubmatch(err.Error()); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		return code == 429 || code >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retryWithBackoff calls f until it succeeds, fails for good or runs out of attempts,
+// sleeping with exponential backoff and jitter in between
+func retryWithBackoff(ctx context.Context, f func() error) error {
+	delay := EMBEDDING_RETRY_BASE_DELAY
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= EMBEDDING_MAX_RETRIES || !isRetryable(err) {
+			return err
+		}
+		wait := delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+		log.Output(1, fmt.Sprintf("retrying in %s after: %s", wait, err.Error()))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// EmbedInBatches embeds inputs using at most EMBEDDING_WORKERS concurrent requests.
+// A batch that fails for good does not fail the rest; it is counted in the report
+// instead. progress, if not nil, is called with the number of inputs handled so far
+func EmbedInBatches(ctx context.Context, inputs []string, embed EmbedFunc, progress func(done int)) EmbeddingReport {
+	report := EmbeddingReport{
+		Embeddings: make([][]float64, len(inputs)),
+		Errors:     []string{},
+	}
+	batches := batchInputs(inputs, EMBEDDING_BATCH_SIZE, EMBEDDING_BATCH_TOKENS)
+	log.Output(1, fmt.Sprintf("embedding %d inputs in %d batches", len(inputs), len(batches)))
+
+	var mu, progressMu sync.Mutex
+	var wg sync.WaitGroup
+	done, reported := 0, 0
+	work := make(chan embeddingBatch)
+	for i := 0; i < EMBEDDING_WORKERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range work {
+				var res [][]float64
+				err := retryWithBackoff(ctx, func() error {
+					var err error
+					res, err = embed(ctx, inputs[b.start:b.end])
+					if err == nil && len(res) != b.end-b.start {
+						err = fmt.Errorf("expected %d embeddings, got %d", b.end-b.start, len(res))
+					}
+					return err
+				})
+
+				mu.Lock()
+				if err != nil {
+					log.Output(1, fmt.Sprintf("embedding inputs %d-%d failed: %s", b.start, b.end, err.Error()))
+					report.Failed += b.end - b.start
+					report.Errors = append(report.Errors, err.Error())
+				} else {
+					copy(report.Embeddings[b.start:b.end], res)
+					// a vector missing from an otherwise complete answer fails its input alone
+					missing := 0
+					for _, v := range res {
+						if len(v) == 0 {
+							missing += 1
+						}
+					}
+					if missing > 0 {
+						log.Output(1, fmt.Sprintf("embedding inputs %d-%d returned %d empty embeddings", b.start, b.end, missing))
+						report.Failed += missing
+						report.Errors = append(report.Errors, fmt.Sprintf("%d empty embeddings", missing))
+					}
+				}
+				done += b.end - b.start
+				n := done
+				mu.Unlock()
+
+				// progress may be slow, as it saves the job, and a worker finding it busy
+				// moves on instead of waiting, since a later call reports more anyway
+				if progress != nil && progressMu.TryLock() {
+					if n > reported {
+						reported = n
+						progress(n)
+					}
+					progressMu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, b := range batches {
+		work <- b
+	}
+	close(work)
+	wg.Wait()
+
+	return report
+}
@@ -0,0 +1,126 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBatchInputs(t *testing.T) {
+	input := "the quick brown fox"
+	n := CountTokens(input)
+	big := strings.Repeat(input+" ", 10)
+	tests := []struct {
+		name      string
+		inputs    []string
+		maxItems  int
+		maxTokens int
+		want      []embeddingBatch
+	}{
+		{"empty", []string{}, 2, 100 * n, []embeddingBatch{}},
+		{"by items", []string{input, input, input, input, input}, 2, 100 * n,
+			[]embeddingBatch{{0, 2}, {2, 4}, {4, 5}}},
+		{"by tokens", []string{input, input, input}, 10, 2 * n,
+			[]embeddingBatch{{0, 2}, {2, 3}}},
+		{"too big alone", []string{input, big, input}, 10, 2 * n,
+			[]embeddingBatch{{0, 1}, {1, 2}, {2, 3}}},
+	}
+	for _, tt := range tests {
+		if got := batchInputs(tt.inputs, tt.maxItems, tt.maxTokens); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: batchInputs = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// fakeEmbed embeds every input as its length, failing the calls fail returns an error for
+func fakeEmbed(fail func(call int, inputs []string) error) (EmbedFunc, *int) {
+	var mu sync.Mutex
+	calls := 0
+	return func(ctx context.Context, inputs []string) ([][]float64, error) {
+		mu.Lock()
+		calls++
+		call := calls
+		mu.Unlock()
+		if err := fail(call, inputs); err != nil {
+			return nil, err
+		}
+		res := make([][]float64, len(inputs))
+		for i, v := range inputs {
+			res[i] = []float64{float64(len(v))}
+		}
+		return res, nil
+	}, &calls
+}
+
+func TestEmbedInBatches(t *testing.T) {
+	inputs := []string{"a", "bb", "ccc"}
+	tests := []struct {
+		name       string
+		embed      func() (EmbedFunc, *int)
+		wantFailed int
+		wantCalls  int
+	}{
+		{"success", func() (EmbedFunc, *int) {
+			return fakeEmbed(func(int, []string) error { return nil })
+		}, 0, 1},
+		{"retried", func() (EmbedFunc, *int) {
+			return fakeEmbed(func(call int, _ []string) error {
+				if call == 1 {
+					return &CompletionHTTPError{StatusCode: 429, Message: "slow down"}
+				}
+				return nil
+			})
+		}, 0, 2},
+		{"not retried", func() (EmbedFunc, *int) {
+			return fakeEmbed(func(int, []string) error {
+				return &CompletionHTTPError{StatusCode: 400, Message: "bad input"}
+			})
+		}, 3, 1},
+		{"not retried without a status", func() (EmbedFunc, *int) {
+			return fakeEmbed(func(int, []string) error { return errors.New("broken") })
+		}, 3, 1},
+		{"short answer", func() (EmbedFunc, *int) {
+			calls := 0
+			return func(ctx context.Context, inputs []string) ([][]float64, error) {
+				calls++
+				return [][]float64{{1}}, nil
+			}, &calls
+		}, 3, 1},
+		{"empty embedding", func() (EmbedFunc, *int) {
+			calls := 0
+			return func(ctx context.Context, inputs []string) ([][]float64, error) {
+				calls++
+				return [][]float64{{1}, {}, {3}}, nil
+			}, &calls
+		}, 1, 1},
+	}
+	for _, tt := range tests {
+		embed, calls := tt.embed()
+		var progress []int
+		report := EmbedInBatches(context.Background(), inputs, embed, func(done int) {
+			progress = append(progress, done)
+		})
+		if report.Failed != tt.wantFailed {
+			t.Errorf("%s: Failed = %d, want %d (%v)", tt.name, report.Failed, tt.wantFailed, report.Errors)
+		}
+		if *calls != tt.wantCalls {
+			t.Errorf("%s: embed was called %d times, want %d", tt.name, *calls, tt.wantCalls)
+		}
+		if (tt.wantFailed > 0) != (len(report.Errors) > 0) {
+			t.Errorf("%s: Errors = %v", tt.name, report.Errors)
+		}
+		if !reflect.DeepEqual(progress, []int{len(inputs)}) {
+			t.Errorf("%s: progress = %v, want [%d]", tt.name, progress, len(inputs))
+		}
+		if tt.wantFailed == 0 {
+			for i, v := range inputs {
+				if !reflect.DeepEqual(report.Embeddings[i], []float64{float64(len(v))}) {
+					t.Errorf("%s: Embeddings[%d] = %v", tt.name, i, report.Embeddings[i])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// the kinds of error an endpoint answers with, each mapped to its own status code
+const (
+	ERR_VALIDATION         = "validation"
+	ERR_UNAUTHORIZED       = "unauthorized"
+	ERR_NOT_FOUND          = "not_found"
+	ERR_METHOD_NOT_ALLOWED = "method_not_allowed"
+	ERR_UPSTREAM           = "upstream"
+	ERR_UNAVAILABLE        = "unavailable"
+	ERR_INTERNAL           = "internal"
+)
+
+// ApiError is an error that knows how it should be presented to the client. Err, if
+// set, is the underlying cause; it is logged but never sent
+type ApiError struct {
+	Code    string
+	Message string
+	Err     error
+}
+
+func (e *ApiError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *ApiError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ApiError) Status() int {
+	switch e.Code {
+	case ERR_VALIDATION:
+		return http.StatusBadRequest
+	case ERR_UNAUTHORIZED:
+		return http.StatusUnauthorized
+	case ERR_NOT_FOUND:
+		return http.StatusNotFound
+	case ERR_METHOD_NOT_ALLOWED:
+		return http.StatusMethodNotAllowed
+	case ERR_UPSTREAM:
+		return http.StatusBadGateway
+	case ERR_UNAVAILABLE:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// ValidationError is for requests that can never succeed as sent
+func ValidationError(format string, args ...interface{}) *ApiError {
+	return &ApiError{Code: ERR_VALIDATION, Message: fmt.Sprintf(format, args...)}
+}
+
+func UnauthorizedError(message string) *ApiError {
+	return &ApiError{Code: ERR_UNAUTHORIZED, Message: message}
+}
+
+func NotFoundError(format string, args ...interface{}) *ApiError {
+	return &ApiError{Code: ERR_NOT_FOUND, Message: fmt.Sprintf(format, args...)}
+}
+
+func MethodNotAllowedError(method string) *ApiError {
+	return &ApiError{Code: ERR_METHOD_NOT_ALLOWED, Message: method + " is not allowed"}
+}
+
+// UpstreamError is for failures of the services we depend on, like the embedding
+// and completion providers or the database
+func UpstreamError(err error, message string) *ApiError {
+	return &ApiError{Code: ERR_UPSTREAM, Message: message, Err: err}
+}
+
+// UnavailableError is for endpoints this deployment is not set up to serve
+func UnavailableError(message string) *ApiError {
+	return &ApiError{Code: ERR_UNAVAILABLE, Message: message}
+}
+
+func InternalError(err error) *ApiError {
+	return &ApiError{Code: ERR_INTERNAL, Message: "internal error", Err: err}
+}
+
+type ErrorBody struct {
+	Success bool        `json:"success"`
+	Error   ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// WriteError answers the request with err, which is treated as an internal error
+// unless it is an ApiError. If the response is already an event stream, the error
+// is sent as an "error" event instead, since the status is long gone
+func WriteError(w http.ResponseWriter, err error) {
+	var apiErr *ApiError
+	if !errors.As(err, &apiErr) {
+		apiErr = InternalError(err)
+	}
+	log.Output(2, fmt.Sprintf("responding with %s error: %s", apiErr.Code, apiErr.Error()))
+
+	body := ErrorBody{
+		Success: false,
+		Error: ErrorDetail{
+			Code:    apiErr.Code,
+			Message: apiErr.Message,
+		},
+	}
+	if w.Header().Get("Content-Type") == "text/event-stream" {
+		(&EventStream{w: w, flusher: flusherOf(w)}).Send("error", body)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status())
+	json.NewEncoder(w).Encode(body)
+}
+
+// Recover is deferred at the top of every Handler as a backstop, turning a panic
+// into an internal error response instead of a dropped connection
+func Recover(w http.ResponseWriter) {
+	if r := recover(); r != nil {
+		log.Output(1, fmt.Sprintf("recovered from panic: %v\n%s", r, debug.Stack()))
+		WriteError(w, InternalError(fmt.Errorf("%v", r)))
+	}
+}
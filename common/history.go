@@ -0,0 +1,88 @@
+package common
+
+import (
+	"context"
+	"log"
+	"strings"
+)
+
+// how much of a conversation goes into a prompt verbatim: at most HISTORY_MAX_TURNS
+// of its latest messages, and only as many of those as fit in HISTORY_MAX_TOKENS. The
+// messages before them are rolled into its summary, of at most SUMMARY_MAX_TOKENS
+const (
+	HISTORY_MAX_TURNS  = 8
+	HISTORY_MAX_TOKENS = 1000
+	SUMMARY_MAX_TOKENS = 256
+)
+
+const SUMMARY_PROMPT = "Summarize the conversation below between a customer and a support assistant in a few sentences, " +
+	"keeping what the customer asked about, the facts they were given and anything still open. Reply with the summary alone."
+
+var summaryTemperature float32 = 0
+
+// historyStart is the index of the first turn kept verbatim. The latest turn always
+// is, whatever its length
+func (c *Conversation) historyStart() int {
+	start := len(c.Turns)
+	tokens := 0
+	for start > c.Summarized && len(c.Turns)-start < HISTORY_MAX_TURNS {
+		n := CountTokens(c.Turns[start-1].Content)
+		if tokens+n > HISTORY_MAX_TOKENS && start < len(c.Turns) {
+			break
+		}
+		tokens += n
+		start--
+	}
+	return start
+}
+
+// History is the part of the conversation that goes into prompts verbatim, see
+// HISTORY_MAX_TURNS. What came before is in Summary, and what Summary does not cover
+// yet, because summarizing it failed, is kept here however long it is
+func (c *Conversation) History() []ChatMessage {
+	return turnMessages(c.Turns[c.Summarized:])
+}
+
+// transcript writes messages out as a dialogue, for prompts about the conversation
+func transcript(messages []ChatMessage) string {
+	var sb strings.Builder
+	for _, v := range messages {
+		if v.Role == ROLE_USER {
+			sb.WriteString("Customer: ")
+		} else {
+			sb.WriteString("Assistant: ")
+		}
+		sb.WriteString(v.Content + "\n")
+	}
+	return sb.String()
+}
+
+// SummarizeHistory rolls the messages of conv that no longer fit into its history into
+// its summary. A failed summary is only logged and tried again on the next call, as
+// the conversation goes on without it
+func SummarizeHistory(ctx context.Context, c Completer, conv *Conversation, settings CompletionSettings) {
+	start := conv.historyStart()
+	if start <= conv.Summarized {
+		return
+	}
+
+	var input strings.Builder
+	if conv.Summary != "" {
+		input.WriteString("Summary of what came before: " + conv.Summary + "\n\n")
+	}
+	input.WriteString(transcript(turnMessages(conv.Turns[conv.Summarized:start])))
+
+	settings.MaxTokens = SUMMARY_MAX_TOKENS
+	settings.Temperature = &summaryTemperature
+	completion, err := c.Complete(ctx, []ChatMessage{
+		{Role: ROLE_SYSTEM, Content: SUMMARY_PROMPT},
+		{Role: ROLE_USER, Content: input.String()},
+	}, settings)
+	summary := strings.TrimSpace(completion.Content)
+	if err != nil || summary == "" {
+		log.Output(1, "could not summarize the conversation, leaving it for the next message")
+		return
+	}
+	conv.Summary = summary
+	conv.Summarized = start
+}
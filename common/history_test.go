@@ -0,0 +1,60 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func turns(contents ...string) []Turn {
+	res := make([]Turn, len(contents))
+	for i, v := range contents {
+		res[i] = Turn{Role: ROLE_USER, Content: v}
+		if i%2 == 1 {
+			res[i].Role = ROLE_ASSISTANT
+		}
+	}
+	return res
+}
+
+func repeatTurns(n int) []Turn {
+	contents := make([]string, n)
+	for i := range contents {
+		contents[i] = "short"
+	}
+	return turns(contents...)
+}
+
+func TestHistoryStart(t *testing.T) {
+	// more tokens than fit into a history on its own, whatever the tokenizer
+	huge := strings.Repeat("a b ", HISTORY_MAX_TOKENS)
+	tests := []struct {
+		name       string
+		turns      []Turn
+		summarized int
+		want       int
+	}{
+		{"empty", []Turn{}, 0, 0},
+		{"few", repeatTurns(3), 0, 0},
+		{"too many", repeatTurns(HISTORY_MAX_TURNS + 2), 0, 2},
+		{"summarized", repeatTurns(HISTORY_MAX_TURNS + 2), 5, 5},
+		{"huge latest turn", turns("short", "short", huge), 0, 2},
+		{"huge earlier turn", turns("short", huge, "short", "short"), 0, 2},
+	}
+	for _, tt := range tests {
+		c := Conversation{Turns: tt.turns, Summarized: tt.summarized}
+		if got := c.historyStart(); got != tt.want {
+			t.Errorf("%s: historyStart = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHistoryKeepsUnsummarized(t *testing.T) {
+	c := Conversation{Turns: repeatTurns(HISTORY_MAX_TURNS + 4), Summarized: 1}
+	if got := len(c.History()); got != HISTORY_MAX_TURNS+3 {
+		t.Errorf("History has %d messages, want %d", got, HISTORY_MAX_TURNS+3)
+	}
+	c.Summarized = c.historyStart()
+	if got := len(c.History()); got != HISTORY_MAX_TURNS {
+		t.Errorf("History has %d messages, want %d", got, HISTORY_MAX_TURNS)
+	}
+}
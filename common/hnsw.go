@@ -0,0 +1,291 @@
+package common
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// parameters of the HNSW graphs built for snapshots. HNSW_M is the number of
+// neighbors a node keeps per layer, twice that on the bottom layer, and the ef values
+// are how many candidates a search keeps on the bottom layer while building and querying
+const (
+	HNSW_M               = 16
+	HNSW_EF_CONSTRUCTION = 100
+	HNSW_EF_SEARCH       = 64
+)
+
+// HNSW is a hierarchical navigable small world graph over the section embeddings of
+// a snapshot, for finding the sections most similar to a query without comparing it
+// to all of them. Nodes are numbered by the position of their section in the
+// snapshot, and similarity is the dot product, as for brute force ranking
+type HNSW struct {
+	Dim      int
+	Entry    int
+	MaxLevel int
+	// the vectors of all nodes, one after the other. float32 halves the memory of an
+	// index, and is plenty to rank by
+	Vectors []float32
+	// Neighbors[node][level] are the nodes linked to node on level
+	Neighbors [][][]int32
+}
+
+type hnswCandidate struct {
+	node  int32
+	score float64
+}
+
+// hnswQueue is a heap of candidates, with the best on top unless worstFirst is set
+type hnswQueue struct {
+	items      []hnswCandidate
+	worstFirst bool
+}
+
+func (q *hnswQueue) Len() int { return len(q.items) }
+func (q *hnswQueue) Less(i, j int) bool {
+	if q.worstFirst {
+		return q.items[i].score < q.items[j].score
+	}
+	return q.items[i].score > q.items[j].score
+}
+func (q *hnswQueue) Swap(i, j int)      { q.items[i], q.items[j] = q.items[j], q.items[i] }
+func (q *hnswQueue) Push(x interface{}) { q.items = append(q.items, x.(hnswCandidate)) }
+func (q *hnswQueue) Pop() interface{} {
+	last := q.items[len(q.items)-1]
+	q.items = q.items[:len(q.items)-1]
+	return last
+}
+func (q *hnswQueue) top() hnswCandidate { return q.items[0] }
+
+func (h *HNSW) Len() int {
+	return len(h.Neighbors)
+}
+
+func (h *HNSW) vector(node int32) []float32 {
+	return h.Vectors[int(node)*h.Dim : (int(node)+1)*h.Dim]
+}
+
+func (h *HNSW) similarity(q []float32, node int32) float64 {
+	v := h.vector(node)
+	var sum float32
+	for i := range q {
+		sum += q[i] * v[i]
+	}
+	return float64(sum)
+}
+
+// searchLayer returns the ef nodes of level closest to q it finds starting from
+// entries, best first
+func (h *HNSW) searchLayer(q []float32, entries []hnswCandidate, ef int, level int, visited []bool) []hnswCandidate {
+	candidates := &hnswQueue{}
+	results := &hnswQueue{worstFirst: true}
+	for _, v := range entries {
+		visited[v.node] = true
+		heap.Push(candidates, v)
+		heap.Push(results, v)
+	}
+	touched := make([]int32, 0, ef*HNSW_M)
+	for _, v := range entries {
+		touched = append(touched, v.node)
+	}
+
+	for candidates.Len() > 0 {
+		c := heap.Pop(candidates).(hnswCandidate)
+		if results.Len() >= ef && c.score < results.top().score {
+			break
+		}
+		for _, n := range h.Neighbors[c.node][level] {
+			if visited[n] {
+				continue
+			}
+			visited[n] = true
+			touched = append(touched, n)
+			score := h.similarity(q, n)
+			if results.Len() < ef || score > results.top().score {
+				heap.Push(candidates, hnswCandidate{n, score})
+				heap.Push(results, hnswCandidate{n, score})
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+	// visited is shared between calls, so leave it as we found it
+	for _, v := range touched {
+		visited[v] = false
+	}
+
+	res := make([]hnswCandidate, results.Len())
+	for i := len(res) - 1; i >= 0; i-- {
+		res[i] = heap.Pop(results).(hnswCandidate)
+	}
+	return res
+}
+
+// selectNeighbors picks up to max of candidates, sorted best first by similarity to
+// the node they are for, skipping those more similar to a candidate already picked
+// than to that node. Without this, tight clusters end up linked only among themselves
+// and a search cannot get into or out of them
+func (h *HNSW) selectNeighbors(candidates []hnswCandidate, max int) []int32 {
+	res := make([]int32, 0, max)
+	for _, c := range candidates {
+		if len(res) == max {
+			break
+		}
+		cv := h.vector(c.node)
+		keep := true
+		for _, r := range res {
+			if h.similarity(cv, r) > c.score {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			res = append(res, c.node)
+		}
+	}
+	return res
+}
+
+// connect links node on level to the best of candidates, which are sorted best first,
+// and links them back, pruning their links again if they have too many
+func (h *HNSW) connect(node int32, candidates []hnswCandidate, level int, max int) {
+	others := make([]hnswCandidate, 0, len(candidates))
+	for _, v := range candidates {
+		if v.node != node {
+			others = append(others, v)
+		}
+	}
+	links := h.selectNeighbors(others, max)
+	h.Neighbors[node][level] = links
+
+	for _, n := range links {
+		back := append(h.Neighbors[n][level], node)
+		if len(back) > max {
+			nv := h.vector(n)
+			ranked := make([]hnswCandidate, len(back))
+			for i, v := range back {
+				ranked[i] = hnswCandidate{v, h.similarity(nv, v)}
+			}
+			sort.Slice(ranked, func(i, j int) bool {
+				return ranked[i].score > ranked[j].score
+			})
+			back = h.selectNeighbors(ranked, max)
+		}
+		h.Neighbors[n][level] = back
+	}
+}
+
+// BuildHNSW indexes vectors, which must all have dim entries
+func BuildHNSW(vectors [][]float64, dim int) (*HNSW, error) {
+	h := &HNSW{
+		Dim:       dim,
+		Vectors:   make([]float32, 0, len(vectors)*dim),
+		Neighbors: make([][][]int32, len(vectors)),
+	}
+	for i, v := range vectors {
+		if len(v) != dim {
+			return nil, fmt.Errorf("vector %d has %d dimensions, expected %d", i, len(v), dim)
+		}
+		for _, x := range v {
+			h.Vectors = append(h.Vectors, float32(x))
+		}
+	}
+
+	// levels are drawn from a fixed seed, so the same vectors always give the same graph
+	rng := rand.New(rand.NewSource(1))
+	mL := 1 / math.Log(HNSW_M)
+	visited := make([]bool, len(vectors))
+	for i := range vectors {
+		node := int32(i)
+		level := int(-math.Log(1-rng.Float64()) * mL)
+		h.Neighbors[i] = make([][]int32, level+1)
+		if i == 0 {
+			h.Entry, h.MaxLevel = 0, level
+			continue
+		}
+
+		q := h.vector(node)
+		entries := []hnswCandidate{{int32(h.Entry), h.similarity(q, int32(h.Entry))}}
+		for l := h.MaxLevel; l > level; l-- {
+			entries = h.searchLayer(q, entries, 1, l, visited)
+		}
+		for l := minInt(level, h.MaxLevel); l >= 0; l-- {
+			entries = h.searchLayer(q, entries, HNSW_EF_CONSTRUCTION, l, visited)
+			max := HNSW_M
+			if l == 0 {
+				max = 2 * HNSW_M
+			}
+			h.connect(node, entries, l, max)
+		}
+		if level > h.MaxLevel {
+			h.Entry, h.MaxLevel = i, level
+		}
+	}
+	return h, nil
+}
+
+// Search returns the (approximately) k nodes most similar to q, best first, along
+// with their similarity
+func (h *HNSW) Search(query []float64, k int, ef int) ([]int, []float64) {
+	if h.Len() == 0 {
+		return nil, nil
+	}
+	if ef < k {
+		ef = k
+	}
+	q := make([]float32, len(query))
+	for i, v := range query {
+		q[i] = float32(v)
+	}
+
+	visited := make([]bool, h.Len())
+	entries := []hnswCandidate{{int32(h.Entry), h.similarity(q, int32(h.Entry))}}
+	for l := h.MaxLevel; l > 0; l-- {
+		entries = h.searchLayer(q, entries, 1, l, visited)
+	}
+	entries = h.searchLayer(q, entries, ef, 0, visited)
+	if len(entries) > k {
+		entries = entries[:k]
+	}
+
+	nodes := make([]int, len(entries))
+	scores := make([]float64, len(entries))
+	for i, v := range entries {
+		nodes[i] = int(v.node)
+		scores[i] = v.score
+	}
+	return nodes, scores
+}
+
+// Vector returns the vector of node as float64s
+func (h *HNSW) Vector(node int) []float64 {
+	res := make([]float64, h.Dim)
+	for i, v := range h.vector(int32(node)) {
+		res[i] = float64(v)
+	}
+	return res
+}
+
+func (h *HNSW) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(h)
+	return buf.Bytes(), err
+}
+
+func DecodeHNSW(data []byte) (*HNSW, error) {
+	var h HNSW
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&h)
+	return &h, err
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"gonum.org/v1/gonum/floats"
+)
+
+func randomUnitVectors(rng *rand.Rand, n int, dim int) [][]float64 {
+	res := make([][]float64, n)
+	for i := range res {
+		v := make([]float64, dim)
+		for j := range v {
+			v[j] = rng.NormFloat64()
+		}
+		floats.Scale(1/floats.Norm(v, 2), v)
+		res[i] = v
+	}
+	return res
+}
+
+func bruteForce(vectors [][]float64, q []float64, k int) []int {
+	nodes := make([]int, len(vectors))
+	for i := range nodes {
+		nodes[i] = i
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return floats.Dot(vectors[nodes[i]], q) > floats.Dot(vectors[nodes[j]], q)
+	})
+	return nodes[:k]
+}
+
+func TestHNSWRecall(t *testing.T) {
+	tests := []struct {
+		n, dim, k int
+		minRecall float64
+	}{
+		{1, 8, 1, 1},
+		{50, 8, 10, 1},
+		{2000, 32, 10, 0.9},
+	}
+	rng := rand.New(rand.NewSource(42))
+	for _, tt := range tests {
+		vectors := randomUnitVectors(rng, tt.n, tt.dim)
+		h, err := BuildHNSW(vectors, tt.dim)
+		if err != nil {
+			t.Fatal(err)
+		}
+		queries := randomUnitVectors(rng, 50, tt.dim)
+		found, total := 0, 0
+		for _, q := range queries {
+			nodes, scores := h.Search(q, tt.k, HNSW_EF_SEARCH)
+			if len(nodes) != tt.k {
+				t.Fatalf("n=%d: got %d results, want %d", tt.n, len(nodes), tt.k)
+			}
+			for i := range scores {
+				if i > 0 && scores[i] > scores[i-1] {
+					t.Fatalf("n=%d: results are not sorted: %v", tt.n, scores)
+				}
+				if math.Abs(scores[i]-floats.Dot(vectors[nodes[i]], q)) > 1e-5 {
+					t.Fatalf("n=%d: score of node %d is %f", tt.n, nodes[i], scores[i])
+				}
+			}
+			want := make(map[int]bool)
+			for _, v := range bruteForce(vectors, q, tt.k) {
+				want[v] = true
+			}
+			for _, v := range nodes {
+				if want[v] {
+					found++
+				}
+			}
+			total += tt.k
+		}
+		if recall := float64(found) / float64(total); recall < tt.minRecall {
+			t.Errorf("n=%d: recall %.3f, want at least %.3f", tt.n, recall, tt.minRecall)
+		}
+	}
+}
+
+func TestBuildHNSWDimensions(t *testing.T) {
+	if _, err := BuildHNSW([][]float64{{1, 0}, {1}}, 2); err == nil {
+		t.Error("expected an error for a vector of the wrong dimension")
+	}
+}
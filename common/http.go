@@ -0,0 +1,73 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RouteParam returns the path parameter following base in routes such as /scrape/{id}.
+// Vercel rewrites those to ?key=value (see vercel.json) while the dev server passes
+// the path through untouched, so both forms are checked
+func RouteParam(r *http.Request, base string, key string) string {
+	if v := r.URL.Query().Get(key); v != "" {
+		return v
+	}
+	segments := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	for i, v := range segments {
+		if v == base && i+1 < len(segments) {
+			param, err := url.PathUnescape(segments[i+1])
+			if err != nil {
+				return ""
+			}
+			return param
+		}
+	}
+	return ""
+}
+
+// WantsEventStream reports whether the client asked for Server-Sent Events
+func WantsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// StreamDelta is the payload of the "delta" events carrying a piece of an answer
+type StreamDelta struct {
+	Content string `json:"content"`
+}
+
+// EventStream writes Server-Sent Events, flushing each one to the client right away
+type EventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func NewEventStream(w http.ResponseWriter) *EventStream {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	return &EventStream{w: w, flusher: flusherOf(w)}
+}
+
+func flusherOf(w http.ResponseWriter) http.Flusher {
+	flusher, _ := w.(http.Flusher)
+	return flusher
+}
+
+// Send writes data as the JSON payload of an event named event
+func (s *EventStream) Send(event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	return nil
+}
@@ -2,66 +2,99 @@ package common
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"log"
+	"math"
 	"os"
-	"regexp"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
-	gogpt "github.com/sashabaranov/go-gpt3"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"gonum.org/v1/gonum/floats"
-	"gonum.org/v1/gonum/mat"
 )
 
+// Domain is one snapshot of a scraped domain. Every scrape adds a new one, and the
+// domain is answered from whichever snapshot is active, see Store
 type Domain struct {
-	Id     primitive.ObjectID `bson:"_id,omitempty"`
-	Domain string             `bson:"domain"`
-	Pages  []Page             `bson:"pages"`
+	Id             primitive.ObjectID `bson:"_id,omitempty"`
+	Domain         string             `bson:"domain"`
+	Scheme         string             `bson:"scheme,omitempty"` // what it was crawled over, empty for https before it was recorded
+	Version        int                `bson:"version"`          // 0 for domains scraped before snapshots
+	CreatedAt      time.Time          `bson:"created_at"`
+	PageCount      int                `bson:"page_count"`
+	SectionCount   int                `bson:"section_count"`
+	EmbeddingModel string             `bson:"embedding_model"` // empty for domains embedded before models were recorded
+	Indexed        bool               `bson:"indexed"`         // whether the snapshot has an HNSW index
+	LexicalIndexed bool               `bson:"lexical_indexed"` // whether it has a BM25 index
+	Pages          []Page             `bson:"pages,omitempty"` // only set on domains being stored, see Store
 }
 
 type Page struct {
 	Route    string    `bson:"route"`
 	Title    string    `bson:"title"`
-	Sections []Section `bson:"sections"`
+	Sections []Section `bson:"sections,omitempty"`
+	// what the last crawl saw of the page, so the next one can tell whether it changed
+	ETag         string   `bson:"etag,omitempty"`
+	LastModified string   `bson:"last_modified,omitempty"`
+	ContentHash  string   `bson:"content_hash,omitempty"`
+	Links        []string `bson:"links,omitempty"` // followed from the page, for when it is not fetched again
 }
 
 type Conversation struct {
 	Id       primitive.ObjectID `bson:"_id,omitempty"` // omitempty is actually really important here
-	DomainId primitive.ObjectID `bson:"domain_id"`
+	DomainId primitive.ObjectID `bson:"domain_id"`     // the snapshot last answered from
+	Domain   string             `bson:"domain"`        // empty for conversations started before snapshots
 	Prompt   string             `bson:"prompt"`
-	Log      []string           `bson:"log"`
+	Turns    []Turn             `bson:"turns"`
+	// the messages before the history that goes into prompts, see SummarizeHistory
+	Summary    string `bson:"summary,omitempty"`
+	Summarized int    `bson:"summarized,omitempty"` // how many of the turns the summary covers
+	// conversations saved before turns have these instead, see migrate
+	Log        []string    `bson:"log,omitempty"`
+	Retrievals []Retrieval `bson:"retrievals,omitempty"`
 }
 
+// CountPseudoTokens counts the words of str, see WordTokenizer. Use CountTokens to
+// fit text into the limits of a model
 func CountPseudoTokens(str string) int {
-	// count the number of words in str using regex
-	re := regexp.MustCompile(`\w+`)
-	return len(re.FindAllString(str, -1))
+	return WordTokenizer{}.Count(str)
 }
 
-func (c *Conversation) AppendAgent(str string) {
-	c.Log = append(c.Log, "[Agent]: "+str)
+// AppendTurn appends an answer, as made by GetConversationCompletion
+func (c *Conversation) AppendTurn(t Turn) {
+	c.Turns = append(c.Turns, t)
 }
 
 func (c *Conversation) AppendUser(str string) {
-	c.Log = append(c.Log, "[User]: "+str)
+	c.Turns = append(c.Turns, Turn{Role: ROLE_USER, Content: str, CreatedAt: time.Now()})
+}
+
+func (c *Conversation) Messages() []ChatMessage {
+	return turnMessages(c.Turns)
 }
 
 func (c *Conversation) String() string {
 	prompt := c.Prompt
-	for _, v := range c.Log {
-		prompt += "\n" + v
+	for _, v := range c.Turns {
+		prompt += "\n" + v.String()
 	}
 	return prompt
 }
 
 type Section struct {
-	Title     string    `bson:"title"`
-	Content   string    `bson:"content"`
-	Embedding []float64 `bson:"embedding"`
+	Title     string      `bson:"title"`
+	Anchor    string      `bson:"anchor,omitempty"` // id of the heading the section starts at, if it had one
+	Content   string      `bson:"content"`
+	Embedding []float64   `bson:"embedding"`
+	Hash      string      `bson:"hash,omitempty"`  // ContentHash of Zip, which the embedding is of
+	Terms     []TermCount `bson:"terms,omitempty"` // of Zip, for the lexical index
 }
 
 func (s *Section) Zip() string {
@@ -82,53 +115,50 @@ func (p *Page) Print() {
 	}
 }
 
-func GetDb() (*mongo.Database, func()) {
+func GetDb() (*mongo.Database, func(), error) {
 	uri := os.Getenv("MONGODB_URI")
 	dbName := os.Getenv("MONGODB_DB_NAME")
 	if uri == "" {
-		log.Fatal("You must set your 'MONGODB_URI' environmental variable.")
+		return nil, nil, InternalError(fmt.Errorf("You must set your 'MONGODB_URI' environmental variable."))
 	}
 	if dbName == "" {
-		log.Fatal("You must set your 'MONGODB_DB_NAME' environmental variable.")
+		return nil, nil, InternalError(fmt.Errorf("You must set your 'MONGODB_DB_NAME' environmental variable."))
 	}
 	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(uri))
-	db := client.Database(dbName)
 	if err != nil {
-		panic(err)
+		return nil, nil, UpstreamError(err, "could not connect to the database")
 	}
+	db := client.Database(dbName)
 	disconnect := func() {
 		if err := client.Disconnect(context.TODO()); err != nil {
-			panic(err)
+			log.Output(1, "could not disconnect from the database: "+err.Error())
 		}
 	}
-	return db, disconnect
+	return db, disconnect, nil
 }
 
-func GetAgentCompletion(c *gogpt.Client, query string) string {
-	req := gogpt.CompletionRequest{
-		Model:            "text-davinci-003",
-		Prompt:           query,
-		MaxTokens:        256,
-		Temperature:      0.7,
-		TopP:             1,
-		PresencePenalty:  0,
-		FrequencyPenalty: 0,
-	}
-	res, err := c.CreateCompletion(context.TODO(), req)
+func GetAgentCompletion(c Completer, messages []ChatMessage, settings CompletionSettings) (Completion, error) {
+	res, err := c.Complete(context.TODO(), messages, settings)
 	if err != nil {
-		panic(err.Error())
+		return res, UpstreamError(err, "could not generate an answer")
 	}
-	return res.Choices[0].Text
+	return res, nil
 }
 
 func (c *Conversation) ZipLog() string {
   str := ""
-  for _, v := range c.Log {
-    str += v + "\n"
+  for _, v := range c.Turns {
+    str += v.String() + "\n"
   }
   return str
 }
 
+// ContentHash identifies content by its bytes, to tell whether it changed between crawls
+func ContentHash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
 func hash(s string) uint32 {
   h := fnv.New32a()
   h.Write([]byte(s))
@@ -160,84 +190,162 @@ func MakeThreadSafeHashSet() ThreadSafeHashSet {
 }
 
 
-const EMBEDDING_LEN = 1536
-const MAX_PSEUDO_TOKENS = 1500
-
-func GetConversationCompletion(c *gogpt.Client, conv Conversation, d Domain) string {
-	chunks := make([]Section, 0)
-	for _, v := range d.Pages {
-		chunks = append(chunks, v.Sections...)
-	}
-  if len(chunks) == 0 {
-    panic("no domain found or domain empty")
-  }
-
-	// data collection
-	rawMatrix := make([]float64, 0, EMBEDDING_LEN*len(chunks))
-	for _, v := range chunks {
-		rawMatrix = append(rawMatrix, v.Embedding...)
+// how many tokens of the conversation and the sections retrieved for it go into a prompt
+const MAX_CONTEXT_TOKENS = 2000
+
+// BuildConversationMessages retrieves the sections of d most relevant to conv and
+// lays them out, together with the assistant's instructions, as a chat for the
+// completer. The sections are retrieved by the latest message, condensed into a query
+// with c, and returned as sources, best match first. If none is similar enough to be
+// used, it returns an *UnanswerableError along with the query
+func BuildConversationMessages(ctx context.Context, store Store, c Completer, e Embedder, conv Conversation, d Domain, cfg DomainConfig) ([]ChatMessage, Retrieval, error) {
+	// getting embedding
+	query := CondenseQuery(ctx, c, conv, cfg.Completion)
+	log.Output(1, "retrieving by "+strconv.Quote(query))
+	retrieval := Retrieval{Query: query, Sources: []Source{}}
+	embeddingRaw, err := GetEmbedding(e, query)
+	if err != nil {
+		return nil, retrieval, err
 	}
-	matrix := mat.NewDense(len(chunks), EMBEDDING_LEN, rawMatrix)
-
-  // getting embedding
-  query := conv.ZipLog()
-  embeddingRaw := GetEmbedding(c, query)
-	embedding := mat.NewVecDense(EMBEDDING_LEN, embeddingRaw)
 
 	// ranking
 	log.Output(1, "constructing prompt")
-	var dists mat.VecDense
-	dists.MulVec(matrix, embedding)
+	ranked, err := RankSections(ctx, store, e, d, cfg.Retrieval, query, embeddingRaw)
+	if err != nil {
+		return nil, retrieval, err
+	}
 
-	originalIndices := make([]int, len(chunks))
-  floats.Scale(-1.0, dists.RawVector().Data)
-	floats.Argsort(dists.RawVector().Data, originalIndices)
+	// drop the sections too unlike the question to answer from
+	minSimilarity := cfg.Retrieval.MinSimilarity
+	bestSimilarity := math.Inf(-1)
+	relevant := make([]RankedSection, 0, len(ranked))
+	for _, v := range ranked {
+		if v.Similarity > bestSimilarity {
+			bestSimilarity = v.Similarity
+		}
+		if minSimilarity <= 0 || v.Similarity >= minSimilarity {
+			relevant = append(relevant, v)
+		}
+	}
+	if len(relevant) == 0 && minSimilarity > 0 {
+		log.Output(1, fmt.Sprintf("no section is relevant enough, the best has a similarity of %.3f", bestSimilarity))
+		return nil, retrieval, &UnanswerableError{BestSimilarity: bestSimilarity, MinSimilarity: minSimilarity}
+	}
 
 	// determine which docs to add
-	tokens := CountPseudoTokens(query)
-	indicesToAdd := make(map[int]bool, 0)
-	for _, v := range originalIndices {
-		tokens += CountPseudoTokens(chunks[v].Zip())
-		if tokens > MAX_PSEUDO_TOKENS {
+	history := conv.History()
+	tokens := CountTokens(conv.Summary)
+	for _, v := range history {
+		tokens += CountTokens(v.Content)
+	}
+	toAdd := make([]RankedSection, 0)
+	for _, v := range Diversify(relevant, cfg.Retrieval) {
+		tokens += CountTokens(v.Section.Zip())
+		if tokens > MAX_CONTEXT_TOKENS {
 			break
 		}
-		indicesToAdd[v] = true
+		toAdd = append(toAdd, v)
+		retrieval.Sources = append(retrieval.Sources, Source{
+			Url:       SectionUrl(d, v.Page.Route, v.Section),
+			Title:     HeadingText(v.Section.Title),
+			PageTitle: HeadingText(v.Page.Title),
+			Score:     v.Score,
+		})
 	}
 
 	// add them back in original order
+	sort.Slice(toAdd, func(i, j int) bool {
+		return toAdd[i].Position < toAdd[j].Position
+	})
 	prompt := ""
-	for i, v := range chunks {
-		if val, ok := indicesToAdd[i]; ok && val {
-			prompt += "\n\n" + v.Zip()
-		}
+	for _, v := range toAdd {
+		prompt += "\n\n" + v.Section.Zip()
 	}
 
-	log.Output(1, fmt.Sprintf("composed ~%d tokens from %d subsections", tokens, len(indicesToAdd)))
+	log.Output(1, fmt.Sprintf("composed ~%d tokens from %d subsections", tokens, len(toAdd)))
+
+	instructions, err := cfg.RenderSystemPrompt()
+	if err != nil {
+		return nil, retrieval, InternalError(err)
+	}
+	prompt += "\n\n" + instructions
+	if conv.Summary != "" {
+		prompt += "\n\nSummary of the conversation before the messages below: " + conv.Summary
+	}
 
-	prompt += "\n\nYou are a chatbot customer support agent for a company and should continue the conversation in a cordial and professional manner using the information provided above alone to guide your responses. If you don't know the answer or the information is not provided above, refer the customer to 800-403-8023. Do not go off-topic or talk about irrelevant things--you are a customer service chatbot. Do not output an answer containing any markdown syntax."
-	prompt += "\n[Agent]: Hello! What can I do for you today?"
-  prompt += "\n" + query
-  prompt += "\n[Agent]: "
+	messages := []ChatMessage{
+		{Role: ROLE_SYSTEM, Content: prompt},
+		{Role: ROLE_ASSISTANT, Content: cfg.WithDefaults().Greeting},
+	}
+	messages = append(messages, history...)
 
 	log.Output(1, prompt)
 
+	return messages, retrieval, nil
+}
+
+// GetConversationCompletion answers conv from d, as an agent turn to append to it.
+// When d has nothing relevant to answer from, the completer is skipped, and the
+// configured answer for that is returned along with the *UnanswerableError
+func GetConversationCompletion(ctx context.Context, store Store, c Completer, e Embedder, conv Conversation, d Domain, cfg DomainConfig) (Turn, error) {
+	start := time.Now()
+	messages, retrieval, err := BuildConversationMessages(ctx, store, c, e, conv, d, cfg)
+	turn := Turn{Role: ROLE_ASSISTANT, Query: retrieval.Query, Sources: retrieval.Sources}
+	var unanswerable *UnanswerableError
+	if errors.As(err, &unanswerable) {
+		turn.Content = cfg.UnansweredAnswer()
+		turn.finish(start)
+		return turn, err
+	} else if err != nil {
+		return turn, err
+	}
+
 	log.Output(1, "requesting completion")
 
 	// response generation
-	agentResponse := GetAgentCompletion(c, prompt)
-
-  return agentResponse
+	completion, err := GetAgentCompletion(c, messages, cfg.Completion)
+	if err != nil {
+		return turn, err
+	}
+	turn.Content, turn.Model, turn.Usage = completion.Content, completion.Model, &completion.Usage
+	turn.finish(start)
+	return turn, nil
 }
 
-func GetEmbedding(c *gogpt.Client, query string) []float64 {
-	embeddingReq := gogpt.EmbeddingRequest{
-		Input: []string{query},
-		Model: gogpt.AdaEmbeddingV2,
+// StreamConversationCompletion is GetConversationCompletion handing every piece of
+// the answer to onDelta as it is generated
+func StreamConversationCompletion(ctx context.Context, store Store, c Completer, e Embedder, conv Conversation, d Domain, cfg DomainConfig, onDelta func(delta string) error) (Turn, error) {
+	start := time.Now()
+	messages, retrieval, err := BuildConversationMessages(ctx, store, c, e, conv, d, cfg)
+	turn := Turn{Role: ROLE_ASSISTANT, Query: retrieval.Query, Sources: retrieval.Sources}
+	var unanswerable *UnanswerableError
+	if errors.As(err, &unanswerable) {
+		turn.Content = cfg.UnansweredAnswer()
+		if err := onDelta(turn.Content); err != nil {
+			return turn, err
+		}
+		turn.finish(start)
+		return turn, unanswerable
+	} else if err != nil {
+		return turn, err
+	}
+
+	log.Output(1, "streaming completion")
+
+	completion, err := c.Stream(ctx, messages, cfg.Completion, onDelta)
+	if err != nil {
+		return turn, UpstreamError(err, "could not generate an answer")
 	}
-	res, err := c.CreateEmbeddings(context.TODO(), embeddingReq)
+	turn.Content, turn.Model, turn.Usage = completion.Content, completion.Model, &completion.Usage
+	turn.finish(start)
+	return turn, nil
+}
+
+func GetEmbedding(e Embedder, query string) ([]float64, error) {
+	res, err := e.Embed(context.TODO(), []string{query})
 	if err != nil {
-		panic(err)
+		return nil, UpstreamError(err, "could not embed the question")
 	}
-	embeddingRaw := res.Data[0].Embedding
-  return embeddingRaw
+	embeddingRaw := res[0]
+	return embeddingRaw, nil
 }
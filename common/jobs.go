@@ -0,0 +1,64 @@
+package common
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// the states a scrape job moves through, in order. Any of them can end in JOB_FAILED
+const (
+	JOB_QUEUED    = "queued"
+	JOB_CRAWLING  = "crawling"
+	JOB_EMBEDDING = "embedding"
+	JOB_UPLOADING = "uploading"
+	JOB_DONE      = "done"
+	JOB_FAILED    = "failed"
+)
+
+// a worker running a job updates it at least every JOB_HEARTBEAT_INTERVAL. A job
+// that is neither queued nor finished and was not updated for JOB_STALE_AFTER lost
+// its worker, and is failed
+const (
+	JOB_HEARTBEAT_INTERVAL = 30 * time.Second
+	JOB_STALE_AFTER        = 5 * time.Minute
+)
+
+// ScrapeJob tracks a crawl running in the background so clients can poll its progress
+type ScrapeJob struct {
+	Id              primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Domain          string             `bson:"domain" json:"domain"`
+	Depth           int                `bson:"depth" json:"depth"`
+	Mode            string             `bson:"mode" json:"mode"`
+	State           string             `bson:"state" json:"state"`
+	Error           string             `bson:"error,omitempty" json:"error,omitempty"`
+	PageCount       int                `bson:"page_count" json:"page_count"`
+	SectionCount    int                `bson:"section_count" json:"section_count"`
+	EmbeddedCount   int                `bson:"embedded_count" json:"embedded_count"`
+	SitemapUrlCount int                `bson:"sitemap_url_count" json:"sitemap_url_count"`
+	SkippedUrls     []string           `bson:"skipped_urls" json:"skipped_urls"`
+	// pages carried over from the previous crawl, and the embeddings reused with them
+	// or with any other section whose text did not change
+	UnchangedPageCount   int `bson:"unchanged_page_count" json:"unchanged_page_count"`
+	ReusedEmbeddingCount int `bson:"reused_embedding_count" json:"reused_embedding_count"`
+	// of the sections that were embedded, how many were found in the embedding cache
+	EmbeddingCacheHits   int `bson:"embedding_cache_hits" json:"embedding_cache_hits"`
+	EmbeddingCacheMisses int `bson:"embedding_cache_misses" json:"embedding_cache_misses"`
+	// sections left out of the domain because their embedding batch kept failing
+	FailedEmbeddingCount int      `bson:"failed_embedding_count" json:"failed_embedding_count"`
+	EmbeddingErrors      []string `bson:"embedding_errors" json:"embedding_errors"`
+	// the snapshot the job produced, set once it is uploaded
+	SnapshotId primitive.ObjectID `bson:"snapshot_id,omitempty" json:"snapshot_id,omitempty"`
+	Version    int                `bson:"version,omitempty" json:"version,omitempty"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt  time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// Running reports whether a worker has the job, that is, whether it left the queue
+// and has yet to finish
+func (j ScrapeJob) Running() bool {
+	return j.State != JOB_QUEUED && j.State != JOB_DONE && j.State != JOB_FAILED
+}
+
+// STALE_JOB_ERROR is the error of the jobs failed by FailStaleScrapeJobs
+const STALE_JOB_ERROR = "the worker running the job stopped responding"
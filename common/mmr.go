@@ -0,0 +1,88 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"math"
+
+	"gonum.org/v1/gonum/floats"
+)
+
+// how many of the best ranked sections Diversify picks from. Far more than fit into a
+// prompt, while keeping it quadratic in something small
+const MMR_CANDIDATES = 64
+
+// Diversify reorders the best of ranked by maximal marginal relevance, so that the
+// sections a prompt is filled with first cover different pages and headings instead of
+// repeating one another. Each pick is the section with the best
+//
+//	lambda * relevance - (1 - lambda) * similarity to the most similar section picked
+//
+// where relevance is the score of the section, on the scale of similarities. No more
+// than MaxSectionsPerPage sections of a page are picked
+func Diversify(ranked []RankedSection, settings RetrievalSettings) []RankedSection {
+	settings = settings.WithDefaults()
+	lambda := *settings.MMRLambda
+	perPage := *settings.MaxSectionsPerPage
+
+	candidates := ranked
+	if len(candidates) > MMR_CANDIDATES {
+		candidates = candidates[:MMR_CANDIDATES]
+	}
+	if len(candidates) == 0 {
+		return candidates
+	}
+
+	// scores of hybrid or lexical rankings are on no scale comparable to similarities,
+	// so relevance is the score mapped onto the range of similarities of the candidates
+	loScore, hiScore := math.Inf(1), math.Inf(-1)
+	loSim, hiSim := math.Inf(1), math.Inf(-1)
+	for _, v := range candidates {
+		loScore, hiScore = math.Min(loScore, v.Score), math.Max(hiScore, v.Score)
+		loSim, hiSim = math.Min(loSim, v.Similarity), math.Max(hiSim, v.Similarity)
+	}
+	relevance := make([]float64, len(candidates))
+	for i, v := range candidates {
+		relevance[i] = hiSim
+		if hiScore > loScore {
+			relevance[i] = loSim + (v.Score-loScore)/(hiScore-loScore)*(hiSim-loSim)
+		}
+	}
+
+	// redundancy[i] is the similarity of candidate i to the most similar one picked
+	redundancy := make([]float64, len(candidates))
+	picked := make([]bool, len(candidates))
+	perRoute := make(map[string]int)
+	res := make([]RankedSection, 0, len(candidates))
+	for {
+		best, bestScore := -1, math.Inf(-1)
+		for i, v := range candidates {
+			if picked[i] || (perPage > 0 && perRoute[v.Page.Route] >= perPage) {
+				continue
+			}
+			score := lambda*relevance[i] - (1-lambda)*redundancy[i]
+			if score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		picked[best] = true
+		chosen := candidates[best]
+		perRoute[chosen.Page.Route] += 1
+		res = append(res, chosen)
+		for i, v := range candidates {
+			if picked[i] || len(v.Section.Embedding) != len(chosen.Section.Embedding) {
+				continue
+			}
+			if sim := floats.Dot(v.Section.Embedding, chosen.Section.Embedding); sim > redundancy[i] || len(res) == 1 {
+				redundancy[i] = sim
+			}
+		}
+	}
+
+	log.Output(1, fmt.Sprintf("diversified %d of %d sections over %d pages", len(res), len(candidates), len(perRoute)))
+	return res
+}
@@ -0,0 +1,39 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiversify(t *testing.T) {
+	ranked := []RankedSection{
+		{Position: 0, Page: Page{Route: "/a"}, Section: Section{Embedding: []float64{1, 0}}, Score: 0.9, Similarity: 0.9},
+		// a near duplicate of the first
+		{Position: 1, Page: Page{Route: "/a"}, Section: Section{Embedding: []float64{1, 0}}, Score: 0.85, Similarity: 0.85},
+		{Position: 2, Page: Page{Route: "/c"}, Section: Section{Embedding: []float64{0, 1}}, Score: 0.8, Similarity: 0.8},
+	}
+	half, all := 0.5, 1.0
+	one, none := 1, 0
+	tests := []struct {
+		name    string
+		ranked  []RankedSection
+		lambda  *float64
+		perPage *int
+		want    []int
+	}{
+		{"empty", []RankedSection{}, &half, &none, []int{}},
+		{"relevance alone", ranked, &all, &none, []int{0, 1, 2}},
+		{"redundancy counts", ranked, &half, &none, []int{0, 2, 1}},
+		{"one per page", ranked, &all, &one, []int{0, 2}},
+	}
+	for _, tt := range tests {
+		res := Diversify(tt.ranked, RetrievalSettings{MMRLambda: tt.lambda, MaxSectionsPerPage: tt.perPage})
+		got := make([]int, len(res))
+		for i, v := range res {
+			got[i] = v.Position
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: positions %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
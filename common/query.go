@@ -0,0 +1,75 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// how many of the last messages of a conversation a query is condensed from, and how
+// long the completer gets to do it before the heuristic is used instead
+const (
+	CONDENSE_HISTORY_MESSAGES = 6
+	CONDENSE_TIMEOUT          = 10 * time.Second
+	CONDENSE_MAX_TOKENS       = 64
+)
+
+const CONDENSE_PROMPT = "Rewrite the last message of the customer in the conversation below as a standalone search query for the documentation of %s, " +
+	"filling in whatever it refers to from earlier messages. Reply with the query alone."
+
+var condenseTemperature float32 = 0
+
+// CondenseQuery turns the latest user message of conv into a query to retrieve
+// sections by. The first message is used as it is; follow-ups are rewritten by the
+// completer to stand on their own, and if that fails, prefixed with the message
+// before them
+func CondenseQuery(ctx context.Context, c Completer, conv Conversation, settings CompletionSettings) string {
+	messages := conv.Messages()
+	latest := -1
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == ROLE_USER {
+			latest = i
+			break
+		}
+	}
+	if latest < 0 {
+		return conv.ZipLog()
+	}
+	if latest == 0 {
+		return messages[latest].Content
+	}
+
+	history := messages[:latest+1]
+	if len(history) > CONDENSE_HISTORY_MESSAGES {
+		history = history[len(history)-CONDENSE_HISTORY_MESSAGES:]
+	}
+	input := transcript(history)
+	if conv.Summary != "" {
+		input = "Summary of what came before: " + conv.Summary + "\n\n" + input
+	}
+
+	settings.MaxTokens = CONDENSE_MAX_TOKENS
+	settings.Temperature = &condenseTemperature
+	ctx, cancel := context.WithTimeout(ctx, CONDENSE_TIMEOUT)
+	defer cancel()
+	completion, err := c.Complete(ctx, []ChatMessage{
+		{Role: ROLE_SYSTEM, Content: fmt.Sprintf(CONDENSE_PROMPT, conv.Domain)},
+		{Role: ROLE_USER, Content: input},
+	}, settings)
+	query := strings.Trim(strings.TrimSpace(completion.Content), `"`)
+	if err == nil && query != "" {
+		return query
+	}
+	if err != nil {
+		log.Output(1, "could not condense the query, falling back to the previous message: "+err.Error())
+	}
+
+	for i := latest - 1; i >= 0; i-- {
+		if messages[i].Role == ROLE_USER {
+			return messages[i].Content + " " + messages[latest].Content
+		}
+	}
+	return messages[latest].Content
+}
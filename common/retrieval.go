@@ -0,0 +1,397 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// snapshots with fewer sections than this are ranked by brute force, which is
+// exact and at that size about as fast as loading an index
+const HNSW_MIN_SECTIONS = 1000
+
+// how many sections a search of an index returns, which must be more than ever fit
+// into a prompt
+const HNSW_TOP_K = 64
+
+// the kinds of search indexes a snapshot can have
+const (
+	INDEX_HNSW = "hnsw"
+	INDEX_BM25 = "bm25"
+)
+
+// how sections are ranked against a query: by embedding similarity, by BM25 over
+// their words, or by both, fused
+const (
+	RETRIEVAL_VECTOR  = "vector"
+	RETRIEVAL_LEXICAL = "lexical"
+	RETRIEVAL_HYBRID  = "hybrid"
+)
+
+// the constant of reciprocal rank fusion, which keeps the first few ranks of either
+// ranking from drowning out the rest
+const RRF_K = 60
+
+// how many sections a lexical search returns
+const LEXICAL_TOP_K = 64
+
+// RetrievalSettings pick how the sections of a domain are ranked. In hybrid mode, a
+// section scores weight / (RRF_K + rank) in either ranking it appears in
+type RetrievalSettings struct {
+	Mode          string   `json:"mode,omitempty" bson:"mode,omitempty"`
+	VectorWeight  *float64 `json:"vector_weight,omitempty" bson:"vector_weight,omitempty"`
+	LexicalWeight *float64 `json:"lexical_weight,omitempty" bson:"lexical_weight,omitempty"`
+	// sections less similar to the question than this are never answered from. 0 turns
+	// it off, as what is similar enough depends on the embedding model
+	MinSimilarity float64 `json:"min_similarity,omitempty" bson:"min_similarity,omitempty"`
+	// how much relevance counts against redundancy when picking sections, from 0 to 1,
+	// see Diversify. 1 keeps the ranking as it is
+	MMRLambda *float64 `json:"mmr_lambda,omitempty" bson:"mmr_lambda,omitempty"`
+	// the most sections picked from one page, 0 for no limit
+	MaxSectionsPerPage *int `json:"max_sections_per_page,omitempty" bson:"max_sections_per_page,omitempty"`
+}
+
+var defaultRetrievalWeight float64 = 1
+
+var defaultMMRLambda float64 = 0.7
+var defaultMaxSectionsPerPage int = 3
+
+var DEFAULT_RETRIEVAL_SETTINGS = RetrievalSettings{
+	Mode:               RETRIEVAL_HYBRID,
+	VectorWeight:       &defaultRetrievalWeight,
+	LexicalWeight:      &defaultRetrievalWeight,
+	MMRLambda:          &defaultMMRLambda,
+	MaxSectionsPerPage: &defaultMaxSectionsPerPage,
+}
+
+func (s RetrievalSettings) WithDefaults() RetrievalSettings {
+	if s.Mode == "" {
+		s.Mode = DEFAULT_RETRIEVAL_SETTINGS.Mode
+	}
+	if s.VectorWeight == nil {
+		s.VectorWeight = DEFAULT_RETRIEVAL_SETTINGS.VectorWeight
+	}
+	if s.LexicalWeight == nil {
+		s.LexicalWeight = DEFAULT_RETRIEVAL_SETTINGS.LexicalWeight
+	}
+	if s.MMRLambda == nil {
+		s.MMRLambda = DEFAULT_RETRIEVAL_SETTINGS.MMRLambda
+	}
+	if s.MaxSectionsPerPage == nil {
+		s.MaxSectionsPerPage = DEFAULT_RETRIEVAL_SETTINGS.MaxSectionsPerPage
+	}
+	return s
+}
+
+func (s RetrievalSettings) Validate() error {
+	if s.Mode != "" && s.Mode != RETRIEVAL_VECTOR && s.Mode != RETRIEVAL_LEXICAL && s.Mode != RETRIEVAL_HYBRID {
+		return fmt.Errorf("retrieval mode must be %s, %s or %s", RETRIEVAL_VECTOR, RETRIEVAL_LEXICAL, RETRIEVAL_HYBRID)
+	}
+	if (s.VectorWeight != nil && *s.VectorWeight < 0) || (s.LexicalWeight != nil && *s.LexicalWeight < 0) {
+		return fmt.Errorf("retrieval weights must not be negative")
+	}
+	if s.MinSimilarity < 0 || s.MinSimilarity >= 1 {
+		return fmt.Errorf("min_similarity must be at least 0 and below 1")
+	}
+	if s.MMRLambda != nil && (*s.MMRLambda < 0 || *s.MMRLambda > 1) {
+		return fmt.Errorf("mmr_lambda must be between 0 and 1")
+	}
+	if s.MaxSectionsPerPage != nil && *s.MaxSectionsPerPage < 0 {
+		return fmt.Errorf("max_sections_per_page must not be negative")
+	}
+	return nil
+}
+
+// RankedSection is a section of a snapshot with how well it matches a query. Score
+// is what sections are ranked by, Similarity that of their embeddings
+type RankedSection struct {
+	Position   int // of the section in its snapshot, see Store
+	Page       Page
+	Section    Section
+	Score      float64
+	Similarity float64
+}
+
+// RankSections returns the sections of d best matching the query, best first, as
+// settings say. Vector rankings of snapshots with an HNSW index only get the best
+// HNSW_TOP_K back, others all sections. Lexical rankings only get the best
+// LEXICAL_TOP_K sharing a term with the query, so a lexical ranking matching nothing
+// falls back to the vector one
+func RankSections(ctx context.Context, store Store, e Embedder, d Domain, settings RetrievalSettings, query string, embedding []float64) ([]RankedSection, error) {
+	settings = settings.WithDefaults()
+
+	var lexical []int
+	var lexicalScores []float64
+	if settings.Mode != RETRIEVAL_VECTOR {
+		index, err := loadBM25(ctx, store, d)
+		if err == nil {
+			lexical, lexicalScores = index.Search(query, LEXICAL_TOP_K)
+			log.Output(1, fmt.Sprintf("found %d of %d sections by their words", len(lexical), index.Len()))
+		} else {
+			log.Output(1, fmt.Sprintf("could not load the lexical index of %s, ranking by embeddings: %s", d.Domain, err.Error()))
+		}
+	}
+
+	if settings.Mode == RETRIEVAL_LEXICAL && len(lexical) > 0 {
+		res, err := lookup(ctx, store, e, d, lexical, embedding)
+		if err != nil {
+			return nil, err
+		}
+		for i := range res {
+			res[i].Score = lexicalScores[i]
+		}
+		return res, nil
+	}
+
+	vector, err := rankVector(ctx, store, e, d, embedding)
+	if err != nil || len(lexical) == 0 {
+		return vector, err
+	}
+	return fuse(ctx, store, e, d, settings, vector, lexical, embedding)
+}
+
+// fuse merges the vector ranking with the positions of the lexical one by reciprocal
+// rank fusion, looking up the sections only the lexical one found
+func fuse(ctx context.Context, store Store, e Embedder, d Domain, settings RetrievalSettings, vector []RankedSection, lexical []int, embedding []float64) ([]RankedSection, error) {
+	byPosition := make(map[int]RankedSection, len(vector)+len(lexical))
+	scores := make(map[int]float64, len(vector)+len(lexical))
+	for rank, v := range vector {
+		byPosition[v.Position] = v
+		scores[v.Position] += *settings.VectorWeight / float64(RRF_K+rank+1)
+	}
+	missing := make([]int, 0)
+	for rank, v := range lexical {
+		if _, ok := byPosition[v]; !ok {
+			missing = append(missing, v)
+		}
+		scores[v] += *settings.LexicalWeight / float64(RRF_K+rank+1)
+	}
+
+	if len(missing) > 0 {
+		found, err := lookup(ctx, store, e, d, missing, embedding)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range found {
+			byPosition[v.Position] = v
+		}
+	}
+
+	res := make([]RankedSection, 0, len(byPosition))
+	for k, v := range byPosition {
+		v.Score = scores[k]
+		res = append(res, v)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Score != res[j].Score {
+			return res[i].Score > res[j].Score
+		}
+		return res[i].Position < res[j].Position
+	})
+	return res, nil
+}
+
+// lookup gets the sections of d at positions, along with their similarity to embedding
+func lookup(ctx context.Context, store Store, e Embedder, d Domain, positions []int, embedding []float64) ([]RankedSection, error) {
+	pages, sections, err := store.GetSections(ctx, d.Id, positions)
+	if err != nil {
+		return nil, StoreError(err, "domain content")
+	}
+	res := make([]RankedSection, len(positions))
+	for i, v := range positions {
+		if len(sections[i].Embedding) != len(embedding) {
+			return nil, InternalError(fmt.Errorf("section embedded with %d dimensions, but %s uses %d", len(sections[i].Embedding), e.Model(), len(embedding)))
+		}
+		res[i] = RankedSection{Position: v, Page: pages[i], Section: sections[i], Similarity: floats.Dot(sections[i].Embedding, embedding)}
+	}
+	return res, nil
+}
+
+// rankVector ranks the sections of d by the similarity of their embeddings
+func rankVector(ctx context.Context, store Store, e Embedder, d Domain, embedding []float64) ([]RankedSection, error) {
+	if d.Indexed {
+		index, err := loadHNSW(ctx, store, d)
+		if err == nil {
+			return searchIndex(ctx, store, e, d, index, embedding)
+		}
+		// the brute force ranking still works, only slower
+		log.Output(1, fmt.Sprintf("could not load the index of %s, ranking by brute force: %s", d.Domain, err.Error()))
+	}
+	return rankAll(ctx, store, e, d, embedding)
+}
+
+func searchIndex(ctx context.Context, store Store, e Embedder, d Domain, index *HNSW, embedding []float64) ([]RankedSection, error) {
+	if index.Dim != e.Dimension() {
+		return nil, InternalError(fmt.Errorf("index built with %d dimensions, but %s uses %d", index.Dim, e.Model(), e.Dimension()))
+	}
+	positions, _ := index.Search(embedding, HNSW_TOP_K, HNSW_EF_SEARCH)
+	if len(positions) == 0 {
+		return nil, NotFoundError("domain %s has no content", d.Domain)
+	}
+
+	res, err := lookup(ctx, store, e, d, positions, embedding)
+	if err != nil {
+		return nil, err
+	}
+	for i := range res {
+		res[i].Score = res[i].Similarity
+	}
+	log.Output(1, fmt.Sprintf("searched %d of %d sections by index", len(res), index.Len()))
+	return res, nil
+}
+
+func rankAll(ctx context.Context, store Store, e Embedder, d Domain, embedding []float64) ([]RankedSection, error) {
+	// data collection
+	dim := e.Dimension()
+	chunks := make([]Section, 0)
+	chunkPages := make([]Page, 0) // the page each chunk comes from
+	rawMatrix := make([]float64, 0)
+	err := store.EachSection(ctx, d.Id, func(p Page, s Section) error {
+		if len(s.Embedding) != dim {
+			return InternalError(fmt.Errorf("section embedded with %d dimensions, but %s uses %d", len(s.Embedding), e.Model(), dim))
+		}
+		rawMatrix = append(rawMatrix, s.Embedding...)
+		s.Embedding = nil // the matrix holds it
+		chunks = append(chunks, s)
+		chunkPages = append(chunkPages, p)
+		return nil
+	})
+	if err != nil {
+		var apiErr *ApiError
+		if errors.As(err, &apiErr) {
+			return nil, err
+		}
+		return nil, StoreError(err, "domain content")
+	}
+	if len(chunks) == 0 {
+		return nil, NotFoundError("domain %s has no content", d.Domain)
+	}
+	matrix := mat.NewDense(len(chunks), dim, rawMatrix)
+
+	// ranking
+	var dists mat.VecDense
+	dists.MulVec(matrix, mat.NewVecDense(dim, embedding))
+
+	originalIndices := make([]int, len(chunks))
+	floats.Scale(-1.0, dists.RawVector().Data)
+	floats.Argsort(dists.RawVector().Data, originalIndices)
+
+	res := make([]RankedSection, len(chunks))
+	for k, v := range originalIndices {
+		section := chunks[v]
+		section.Embedding = rawMatrix[v*dim : (v+1)*dim]
+		score := -dists.AtVec(k) // sorted along with the indices, and negated
+		res[k] = RankedSection{
+			Position:   v,
+			Page:       chunkPages[v],
+			Section:    section,
+			Score:      score,
+			Similarity: score,
+		}
+	}
+	return res, nil
+}
+
+// snapshots never change, so their indexes are kept around for as long as the process
+// lives, up to HNSW_CACHE_SIZE of them
+const HNSW_CACHE_SIZE = 4
+
+type indexCacheKey struct {
+	id   primitive.ObjectID
+	kind string
+}
+
+var indexCacheMu sync.Mutex
+var indexCache = map[indexCacheKey]interface{}{}
+
+// loadIndex returns the cached index of kind of a snapshot, or the one build returns
+func loadIndex(id primitive.ObjectID, kind string, build func() (interface{}, error)) (interface{}, error) {
+	key := indexCacheKey{id, kind}
+	indexCacheMu.Lock()
+	index, ok := indexCache[key]
+	indexCacheMu.Unlock()
+	if ok {
+		return index, nil
+	}
+
+	index, err := build()
+	if err != nil {
+		return nil, err
+	}
+
+	indexCacheMu.Lock()
+	defer indexCacheMu.Unlock()
+	if len(indexCache) >= HNSW_CACHE_SIZE {
+		for k := range indexCache {
+			delete(indexCache, k)
+			break
+		}
+	}
+	indexCache[key] = index
+	return index, nil
+}
+
+func loadHNSW(ctx context.Context, store Store, d Domain) (*HNSW, error) {
+	index, err := loadIndex(d.Id, INDEX_HNSW, func() (interface{}, error) {
+		data, err := store.GetIndex(ctx, d.Id, INDEX_HNSW)
+		if err != nil {
+			return nil, err
+		}
+		return DecodeHNSW(data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return index.(*HNSW), nil
+}
+
+// loadBM25 loads the lexical index of d. Snapshots from before there were any get one
+// built from their sections, which is only kept in memory
+func loadBM25(ctx context.Context, store Store, d Domain) (*BM25, error) {
+	index, err := loadIndex(d.Id, INDEX_BM25, func() (interface{}, error) {
+		if d.LexicalIndexed {
+			data, err := store.GetIndex(ctx, d.Id, INDEX_BM25)
+			if err != nil {
+				return nil, err
+			}
+			return DecodeBM25(data)
+		}
+		pages := make([]Page, 0)
+		err := store.EachSection(ctx, d.Id, func(p Page, s Section) error {
+			s.Embedding = nil
+			p.Sections = []Section{s}
+			pages = append(pages, p)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return BuildBM25(pages), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return index.(*BM25), nil
+}
+
+// BuildIndex builds the HNSW index of the sections of pages, in the order they are
+// stored in, if there are enough of them to be worth it. It returns nil otherwise
+func BuildIndex(pages []Page, dim int) (*HNSW, error) {
+	vectors := make([][]float64, 0)
+	for _, page := range pages {
+		for _, v := range page.Sections {
+			vectors = append(vectors, v.Embedding)
+		}
+	}
+	if len(vectors) < HNSW_MIN_SECTIONS {
+		return nil, nil
+	}
+	return BuildHNSW(vectors, dim)
+}
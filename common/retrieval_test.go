@@ -0,0 +1,79 @@
+package common
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestFuse(t *testing.T) {
+	ctx := context.Background()
+	store := openTestFileStore(t)
+	d, err := store.InsertSnapshot(ctx, Domain{Domain: "example.com", Pages: []Page{
+		{Route: "/a", Sections: []Section{
+			{Content: "zero", Embedding: []float64{1, 0}},
+			{Content: "one", Embedding: []float64{0.6, 0.8}},
+		}},
+		{Route: "/b", Sections: []Section{
+			{Content: "two", Embedding: []float64{0, 1}},
+		}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewHashingEmbedder(LOCAL_EMBEDDING_LEN)
+
+	embedding := []float64{1, 0}
+	vector := []RankedSection{
+		{Position: 0, Section: Section{Content: "zero"}, Similarity: 1},
+		{Position: 1, Section: Section{Content: "one"}, Similarity: 0.6},
+	}
+	one, two := 1.0, 2.0
+	tests := []struct {
+		name          string
+		vectorWeight  *float64
+		lexicalWeight *float64
+		lexical       []int
+		want          []int
+	}{
+		{"agreeing", &one, &one, []int{0, 1}, []int{0, 1}},
+		{"lexical only found", &one, &one, []int{2, 0}, []int{0, 2, 1}},
+		{"vector weighs more", &two, &one, []int{2, 0}, []int{0, 1, 2}},
+		{"lexical weighs more", &one, &two, []int{2, 1}, []int{1, 2, 0}},
+	}
+	for _, tt := range tests {
+		settings := RetrievalSettings{VectorWeight: tt.vectorWeight, LexicalWeight: tt.lexicalWeight}
+		res, err := fuse(ctx, store, e, d, settings, vector, tt.lexical, embedding)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		got := make([]int, len(res))
+		for i, v := range res {
+			got[i] = v.Position
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: positions %v, want %v", tt.name, got, tt.want)
+		}
+		for _, v := range res {
+			want := 0.0
+			for rank, p := range vector {
+				if p.Position == v.Position {
+					want += *tt.vectorWeight / float64(RRF_K+rank+1)
+				}
+			}
+			for rank, p := range tt.lexical {
+				if p == v.Position {
+					want += *tt.lexicalWeight / float64(RRF_K+rank+1)
+				}
+			}
+			if math.Abs(v.Score-want) > 1e-12 {
+				t.Errorf("%s: score of %d is %f, want %f", tt.name, v.Position, v.Score, want)
+			}
+			// sections only the lexical ranking found are looked up
+			if v.Position == 2 && (v.Section.Content != "two" || v.Page.Route != "/b" || v.Similarity != 0) {
+				t.Errorf("%s: looked up %+v", tt.name, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package common
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/temoto/robotstxt"
+)
+
+// the user agent the scraper identifies itself with. robots.txt groups are matched
+// against it by prefix, so a "chatassist" group applies to us
+const SCRAPER_USER_AGENT = "chatassist-scraper/1.0"
+
+// RobotsPolicy fetches robots.txt once per host and answers whether the scraper
+// may visit a given url, and how long it has to wait between requests
+type RobotsPolicy struct {
+	agent  string
+	client *http.Client
+	mu     sync.Mutex
+	hosts  map[string]*robotstxt.RobotsData
+}
+
+func NewRobotsPolicy(agent string) *RobotsPolicy {
+	return &RobotsPolicy{
+		agent:  agent,
+		client: &http.Client{Timeout: 10 * time.Second},
+		hosts:  map[string]*robotstxt.RobotsData{},
+	}
+}
+
+func (p *RobotsPolicy) rules(u *url.URL) *robotstxt.RobotsData {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if robots, ok := p.hosts[u.Host]; ok {
+		return robots
+	}
+
+	robotsUrl := u.Scheme + "://" + u.Host + "/robots.txt"
+	robots, err := p.fetch(robotsUrl)
+	if err != nil {
+		// an unreachable or malformed robots.txt places no restrictions on us
+		log.Output(1, "could not read "+robotsUrl+": "+err.Error())
+		robots, _ = robotstxt.FromString("")
+	}
+	p.hosts[u.Host] = robots
+	return robots
+}
+
+func (p *RobotsPolicy) fetch(robotsUrl string) (*robotstxt.RobotsData, error) {
+	req, err := http.NewRequest("GET", robotsUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", p.agent)
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return robotstxt.FromResponse(res)
+}
+
+// Allowed reports whether the Allow/Disallow rules for our user agent permit u
+func (p *RobotsPolicy) Allowed(u *url.URL) bool {
+	return p.rules(u).TestAgent(u.RequestURI(), p.agent)
+}
+
+// CrawlDelay returns the Crawl-delay requested for our user agent on u's host, or 0
+func (p *RobotsPolicy) CrawlDelay(u *url.URL) time.Duration {
+	return p.rules(u).FindGroup(p.agent).CrawlDelay
+}
+
+// Sitemaps returns the Sitemap urls advertised in u's host's robots.txt
+func (p *RobotsPolicy) Sitemaps(u *url.URL) []string {
+	return p.rules(u).Sitemaps
+}
@@ -0,0 +1,114 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// how deep sitemap indexes may nest, and how many page urls we collect at most
+const MAX_SITEMAP_DEPTH = 3
+const MAX_SITEMAP_URLS = 10000
+
+// urlsets and sitemap indexes share the same shape, so one struct decodes both
+type sitemapDocument struct {
+	Urls     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+type sitemapCrawler struct {
+	client  *http.Client
+	visited map[string]bool
+	urls    []string
+}
+
+// DiscoverSitemapUrls collects the page urls listed in the sitemaps of entry's host.
+// Sitemaps are taken from the robots.txt Sitemap lines plus the conventional
+// /sitemap.xml, and nested sitemap indexes and gzipped sitemaps are followed
+func DiscoverSitemapUrls(entry *url.URL, robots *RobotsPolicy) []string {
+	sc := sitemapCrawler{
+		client:  &http.Client{Timeout: 10 * time.Second},
+		visited: map[string]bool{},
+		urls:    []string{},
+	}
+
+	roots := append([]string{}, robots.Sitemaps(entry)...)
+	roots = append(roots, entry.Scheme+"://"+entry.Host+"/sitemap.xml")
+	for _, v := range roots {
+		sc.crawl(v, 0)
+	}
+	return sc.urls
+}
+
+func (sc *sitemapCrawler) crawl(sitemapUrl string, depth int) {
+	if depth > MAX_SITEMAP_DEPTH || sc.visited[sitemapUrl] || len(sc.urls) >= MAX_SITEMAP_URLS {
+		return
+	}
+	sc.visited[sitemapUrl] = true
+
+	doc, err := sc.fetch(sitemapUrl)
+	if err != nil {
+		log.Output(1, "could not read sitemap "+sitemapUrl+": "+err.Error())
+		return
+	}
+	log.Output(1, fmt.Sprintf("sitemap %s lists %d pages and %d sitemaps", sitemapUrl, len(doc.Urls), len(doc.Sitemaps)))
+
+	for _, v := range doc.Urls {
+		if len(sc.urls) >= MAX_SITEMAP_URLS {
+			return
+		}
+		if loc := strings.TrimSpace(v.Loc); loc != "" {
+			sc.urls = append(sc.urls, loc)
+		}
+	}
+	for _, v := range doc.Sitemaps {
+		sc.crawl(strings.TrimSpace(v.Loc), depth+1)
+	}
+}
+
+func (sc *sitemapCrawler) fetch(sitemapUrl string) (sitemapDocument, error) {
+	var doc sitemapDocument
+
+	req, err := http.NewRequest("GET", sitemapUrl, nil)
+	if err != nil {
+		return doc, err
+	}
+	req.Header.Set("User-Agent", SCRAPER_USER_AGENT)
+	res, err := sc.client.Do(req)
+	if err != nil {
+		return doc, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return doc, fmt.Errorf("status code %d", res.StatusCode)
+	}
+
+	// .xml.gz sitemaps arrive as raw gzip rather than with a Content-Encoding the
+	// http client would undo for us, so sniff the magic bytes
+	buffered := bufio.NewReader(res.Body)
+	var body io.Reader = buffered
+	magic, _ := buffered.Peek(2)
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return doc, err
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	err = xml.NewDecoder(body).Decode(&doc)
+	return doc, err
+}
@@ -0,0 +1,35 @@
+package common
+
+import "context"
+
+// the number of snapshots kept per domain, the active one included, so that there
+// is always something to roll back to
+const SNAPSHOTS_KEPT = 5
+
+// PruneSnapshots deletes the snapshots of domain beyond the newest keep, sparing the
+// active one even if it is older
+func PruneSnapshots(ctx context.Context, store Store, domain string, keep int) error {
+	active, err := store.GetDomain(ctx, domain)
+	if err != nil {
+		return err
+	}
+	snapshots, err := store.ListSnapshots(ctx, domain)
+	if err != nil {
+		return err
+	}
+
+	kept := 0
+	for _, v := range snapshots {
+		if v.Id == active.Id {
+			continue
+		}
+		if kept < keep-1 {
+			kept++
+			continue
+		}
+		if err := store.DeleteSnapshot(ctx, v.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package common
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf16"
+)
+
+// how many characters of a section a snippet shows, and how many of them come before
+// the first match it shows
+const (
+	SNIPPET_LENGTH  = 240
+	SNIPPET_CONTEXT = 60
+)
+
+// Highlight marks a match in a snippet, from Start up to End. Offsets are in UTF-16
+// code units, as JavaScript indexes strings
+type Highlight struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+type match struct {
+	start int
+	end   int
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// findTerms returns where the terms of query occur as whole words in text, in order
+// and without overlaps, as rune offsets
+func findTerms(text []rune, query string) []match {
+	lower := make([]rune, len(text))
+	for i, r := range text {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	covered := make([]bool, len(text))
+	for _, t := range CountTerms(query) {
+		term := []rune(t.Term)
+		for i := 0; i+len(term) <= len(lower); i++ {
+			if (i > 0 && isWordRune(lower[i-1])) || (i+len(term) < len(lower) && isWordRune(lower[i+len(term)])) {
+				continue
+			}
+			if string(lower[i:i+len(term)]) == t.Term {
+				for j := i; j < i+len(term); j++ {
+					covered[j] = true
+				}
+			}
+		}
+	}
+
+	res := make([]match, 0)
+	for i := 0; i < len(covered); i++ {
+		if !covered[i] {
+			continue
+		}
+		start := i
+		for i < len(covered) && covered[i] {
+			i++
+		}
+		res = append(res, match{start, i})
+	}
+	return res
+}
+
+// utf16Len is the length of runes in UTF-16 code units
+func utf16Len(runes []rune) int {
+	n := 0
+	for _, r := range runes {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
+
+// Snippet cuts the part of content showing the most matches of the terms of query out
+// of it, and returns it along with where the matches are in it
+func Snippet(content string, query string) (string, []Highlight) {
+	text := []rune(strings.TrimSpace(content))
+	matches := findTerms(text, query)
+
+	// the window starting shortly before the match that fits the most matches after it
+	start, best := 0, 0
+	for i, m := range matches {
+		from := m.start - SNIPPET_CONTEXT
+		if from < 0 {
+			from = 0
+		}
+		count := 0
+		for _, n := range matches[i:] {
+			if n.end > from+SNIPPET_LENGTH {
+				break
+			}
+			count++
+		}
+		if count > best {
+			start, best = from, count
+		}
+	}
+	end := start + SNIPPET_LENGTH
+	if end > len(text) {
+		end = len(text)
+		start = end - SNIPPET_LENGTH
+		if start < 0 {
+			start = 0
+		}
+	}
+	// don't cut words in half
+	for start > 0 && start < end && isWordRune(text[start-1]) && isWordRune(text[start]) {
+		start++
+	}
+	for end < len(text) && end > start && isWordRune(text[end-1]) && isWordRune(text[end]) {
+		end--
+	}
+
+	prefix := []rune{}
+	if start > 0 {
+		prefix = []rune("…")
+	}
+	suffix := ""
+	if end < len(text) {
+		suffix = "…"
+	}
+
+	highlights := make([]Highlight, 0)
+	offset := utf16Len(prefix)
+	for _, m := range matches {
+		if m.start < start || m.end > end {
+			continue
+		}
+		highlights = append(highlights, Highlight{
+			Start: offset + utf16Len(text[start:m.start]),
+			End:   offset + utf16Len(text[start:m.end]),
+		})
+	}
+	return string(prefix) + string(text[start:end]) + suffix, highlights
+}
@@ -0,0 +1,64 @@
+package common
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestSnippet(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		query   string
+		want    string
+		// the highlighted text, as JavaScript would slice it out of the snippet
+		wantHighlighted []string
+	}{
+		{"plain", "Returns are free.", "returns", "Returns are free.", []string{"Returns"}},
+		{"whole words only", "Shipping ships a ship.", "ship", "Shipping ships a ship.", []string{"ship"}},
+		{"astral plane", "😀 Hello 😀 hello", "hello", "😀 Hello 😀 hello", []string{"Hello", "hello"}},
+		{"accents", "Ça coûte cher, très cher.", "cher", "Ça coûte cher, très cher.", []string{"cher", "cher"}},
+		{"several terms", "the red car", "red car", "the red car", []string{"red", "car"}},
+		{"no match", "nothing here", "else", "nothing here", []string{}},
+	}
+	for _, tt := range tests {
+		got, highlights := Snippet(tt.content, tt.query)
+		if got != tt.want {
+			t.Errorf("%s: Snippet = %q, want %q", tt.name, got, tt.want)
+		}
+		units := utf16.Encode([]rune(got))
+		highlighted := make([]string, len(highlights))
+		for i, v := range highlights {
+			if v.Start < 0 || v.End > len(units) || v.Start >= v.End {
+				t.Fatalf("%s: highlight %+v out of %d units", tt.name, v, len(units))
+			}
+			highlighted[i] = string(utf16.Decode(units[v.Start:v.End]))
+		}
+		if !reflect.DeepEqual(highlighted, tt.wantHighlighted) {
+			t.Errorf("%s: highlighted %q, want %q", tt.name, highlighted, tt.wantHighlighted)
+		}
+	}
+}
+
+func TestSnippetCut(t *testing.T) {
+	long := strings.Repeat("filler words here ", 30)
+	got, highlights := Snippet(long+"🎉 the refund policy 🎉 "+long, "refund")
+	units := utf16.Encode([]rune(got))
+	if len(highlights) != 1 || string(utf16.Decode(units[highlights[0].Start:highlights[0].End])) != "refund" {
+		t.Errorf("highlights %+v of %q", highlights, got)
+	}
+	if !strings.HasPrefix(got, "…") || !strings.HasSuffix(got, "…") {
+		t.Errorf("Snippet = %q, expected it cut on both ends", got)
+	}
+	if n := len([]rune(got)); n > SNIPPET_LENGTH+2 {
+		t.Errorf("Snippet is %d characters long", n)
+	}
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(got, "…"), "…")
+	for _, v := range strings.Fields(trimmed) {
+		if v != "filler" && v != "words" && v != "here" && v != "the" && v != "refund" && v != "policy" && v != "🎉" {
+			t.Errorf("Snippet cut a word in half: %q", v)
+		}
+	}
+}
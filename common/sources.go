@@ -0,0 +1,54 @@
+package common
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Source is a section that was put into the prompt of an answer, so that the answer
+// can be attributed
+type Source struct {
+	Url       string  `json:"url" bson:"url"`
+	Title     string  `json:"title" bson:"title"`
+	PageTitle string  `json:"page_title" bson:"page_title"`
+	Score     float64 `json:"score" bson:"score"`
+}
+
+// Retrieval is the sources retrieved for an answer and the query they were retrieved
+// by, see BuildConversationMessages. Conversations saved before turns kept them
+// apart from their log, with Turn the index of the answer in it
+type Retrieval struct {
+	Turn    int      `json:"turn" bson:"turn"`
+	Query   string   `json:"query,omitempty" bson:"query,omitempty"`
+	Sources []Source `json:"sources" bson:"sources"`
+}
+
+// HeadingText strips the markdown leader and continuation marker processPage adds to
+// section titles
+func HeadingText(title string) string {
+	title = strings.TrimLeft(title, "#")
+	for strings.HasSuffix(title, " CONTINUED") {
+		title = strings.TrimSuffix(title, " CONTINUED")
+	}
+	return strings.TrimSpace(title)
+}
+
+var slugRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// SectionUrl is the absolute url of a section of d, pointing at its heading. Pages that
+// gave the heading no id get the slug most static site generators would have used
+func SectionUrl(d Domain, route string, s Section) string {
+	scheme := d.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	base := scheme + "://" + strings.SplitN(d.Domain, "/", 2)[0]
+	anchor := s.Anchor
+	if anchor == "" {
+		anchor = strings.Trim(slugRe.ReplaceAllString(strings.ToLower(HeadingText(s.Title)), "-"), "-")
+	}
+	if anchor == "" {
+		return base + route
+	}
+	return base + route + "#" + anchor
+}
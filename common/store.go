@@ -0,0 +1,132 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrNotFound is returned by a Store when the requested document does not exist
+var ErrNotFound = errors.New("not found")
+
+// ErrJobFinished is returned by UpdateScrapeJob for a job that is done or failed
+// already, for instance because it was given up on as stale while its worker ran on
+var ErrJobFinished = errors.New("scrape job already finished")
+
+// Store persists everything the endpoints work with. Domains are returned without
+// their pages; those are read with GetPages and EachSection, so that a big domain
+// never has to be held in memory at once
+type Store interface {
+	// GetDomain returns the active snapshot of domain
+	GetDomain(ctx context.Context, domain string) (Domain, error)
+	// GetDomainById returns any snapshot, active or not
+	GetDomainById(ctx context.Context, id primitive.ObjectID) (Domain, error)
+	// InsertSnapshot stores d along with its pages and sections as the next version of
+	// its domain, and returns it with its id, version and counts set. The snapshot is
+	// not used until it is activated
+	InsertSnapshot(ctx context.Context, d Domain) (Domain, error)
+	// ActivateSnapshot makes the snapshot with id the one domain is answered from
+	ActivateSnapshot(ctx context.Context, domain string, id primitive.ObjectID) error
+	// ListSnapshots returns the snapshots of domain, newest first
+	ListSnapshots(ctx context.Context, domain string) ([]Domain, error)
+	// DeleteSnapshot removes a snapshot and its content
+	DeleteSnapshot(ctx context.Context, id primitive.ObjectID) error
+	// GetPages returns the pages of a snapshot with their sections left out
+	GetPages(ctx context.Context, domainId primitive.ObjectID) ([]Page, error)
+	// EachSection calls f with every section of a snapshot and the page it is on (again
+	// without sections), stopping at the first error f returns. Sections come in the
+	// order they were stored in, their position in the snapshot
+	EachSection(ctx context.Context, domainId primitive.ObjectID, f func(p Page, s Section) error) error
+	// GetSections returns the sections of a snapshot at positions and the pages (without
+	// sections) they are on
+	GetSections(ctx context.Context, domainId primitive.ObjectID, positions []int) ([]Page, []Section, error)
+	// PutIndex and GetIndex store the encoded search indexes of a snapshot, one of every
+	// kind, see INDEX_HNSW and INDEX_BM25
+	PutIndex(ctx context.Context, domainId primitive.ObjectID, kind string, data []byte) error
+	GetIndex(ctx context.Context, domainId primitive.ObjectID, kind string) ([]byte, error)
+
+	GetDomainConfig(ctx context.Context, domain string) (DomainConfig, error)
+	PutDomainConfig(ctx context.Context, cfg DomainConfig) (DomainConfig, error)
+	DeleteDomainConfig(ctx context.Context, domain string) error
+
+	InsertConversation(ctx context.Context, c Conversation) (Conversation, error)
+	GetConversation(ctx context.Context, id primitive.ObjectID) (Conversation, error)
+	UpdateConversation(ctx context.Context, c Conversation) error
+	// ListConversations returns the conversations matching filter, newest first
+	ListConversations(ctx context.Context, filter ConversationFilter) ([]Conversation, error)
+	// DeleteConversation deletes a conversation along with the unanswered questions
+	// recorded from it
+	DeleteConversation(ctx context.Context, id primitive.ObjectID) error
+
+	// GetEmbeddings returns the cached embeddings made by model of the inputs with
+	// hashes, by hash. Hashes that were never cached are left out
+	GetEmbeddings(ctx context.Context, model string, hashes []string) (map[string][]float64, error)
+	PutEmbeddings(ctx context.Context, model string, embeddings map[string][]float64) error
+
+	InsertUnansweredQuestion(ctx context.Context, q UnansweredQuestion) (UnansweredQuestion, error)
+
+	InsertScrapeJob(ctx context.Context, job ScrapeJob) (ScrapeJob, error)
+	GetScrapeJob(ctx context.Context, id primitive.ObjectID) (ScrapeJob, error)
+	// UpdateScrapeJob saves the progress of a job, which must not be finished yet
+	UpdateScrapeJob(ctx context.Context, job ScrapeJob) error
+	// ClaimScrapeJob takes the oldest queued job off the queue by moving it to
+	// JOB_CRAWLING, so that no other worker runs it too. ErrNotFound if there is none
+	ClaimScrapeJob(ctx context.Context) (ScrapeJob, error)
+	// TouchScrapeJob updates nothing but the UpdatedAt of a job, see JOB_HEARTBEAT_INTERVAL
+	TouchScrapeJob(ctx context.Context, id primitive.ObjectID) error
+	// FailStaleScrapeJobs fails the running jobs last updated before before, returning
+	// how many there were
+	FailStaleScrapeJobs(ctx context.Context, before time.Time) (int, error)
+
+	Close() error
+}
+
+// ConversationFilter selects conversations by their domain and when they were
+// started. Zero fields select everything
+type ConversationFilter struct {
+	Domain string
+	// the snapshots of Domain, to also find the conversations started before
+	// snapshots, which only know theirs
+	DomainIds []primitive.ObjectID
+	From      time.Time          // started at or after
+	To        time.Time          // started before
+	Before    primitive.ObjectID // started before this conversation, to page through them
+	Limit     int
+}
+
+const (
+	STORE_MONGO = "mongo"
+	STORE_FILE  = "file"
+)
+
+const DEFAULT_STORE_PATH = ".data/store.json"
+
+// GetStore opens the store selected by STORE: mongo (the default, configured by
+// MONGODB_URI and MONGODB_DB_NAME) or file, a JSON file at STORE_PATH that lets the
+// dev server run without a database
+func GetStore() (Store, error) {
+	switch os.Getenv("STORE") {
+	case "", STORE_MONGO:
+		return NewMongoStore()
+	case STORE_FILE:
+		path := os.Getenv("STORE_PATH")
+		if path == "" {
+			path = DEFAULT_STORE_PATH
+		}
+		return OpenFileStore(path)
+	default:
+		return nil, InternalError(fmt.Errorf("unknown STORE %q", os.Getenv("STORE")))
+	}
+}
+
+// StoreError wraps an error from a Store for the client, what naming the document
+func StoreError(err error, what string) error {
+	if errors.Is(err, ErrNotFound) {
+		return NotFoundError("%s not found", what)
+	}
+	return UpstreamError(err, "could not access "+what)
+}
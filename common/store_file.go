@@ -0,0 +1,587 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fileData is the whole content of a FileStore, with documents keyed by hex id
+type fileData struct {
+	Domains       map[string]Domain       `json:"domains"`
+	DomainConfigs map[string]DomainConfig `json:"domain_configs"`
+	Conversations map[string]Conversation `json:"conversations"`
+	ScrapeJobs    map[string]ScrapeJob    `json:"scrape_jobs"`
+	// questions there was no content for, oldest first
+	UnansweredQuestions []UnansweredQuestion `json:"unanswered_questions"`
+	// the id of the active snapshot of every domain
+	Heads map[string]string `json:"heads"`
+	// the search indexes of snapshots by snapshot id and kind, see indexKey
+	Indexes map[string][]byte `json:"indexes"`
+}
+
+// FileStore keeps everything in memory and writes it out to a single JSON file after
+// every change. It is meant for the dev server and tests, not for production. The file
+// is only read once, so no two processes may use it at the same time
+type FileStore struct {
+	path string
+	mu   sync.Mutex
+	data fileData
+	// cached embeddings by model, then input hash. There are far too many of them to
+	// write out after every batch with the rest, so they are appended to a file of
+	// their own instead, see embeddingsPath
+	embeddings map[string]map[string][]float64
+}
+
+// embeddingEntry is a line of the embeddings file
+type embeddingEntry struct {
+	Model     string    `json:"model"`
+	Hash      string    `json:"hash"`
+	Embedding []float64 `json:"embedding"`
+}
+
+// a background scrape job and the requests around it must share one view of the
+// file, or they would overwrite each other's changes
+var fileStoresMu sync.Mutex
+var fileStores = map[string]*FileStore{}
+
+// OpenFileStore returns the store kept at path, creating the file on first write
+func OpenFileStore(path string) (*FileStore, error) {
+	fileStoresMu.Lock()
+	defer fileStoresMu.Unlock()
+	if s, ok := fileStores[path]; ok {
+		return s, nil
+	}
+
+	s := &FileStore{path: path}
+	raw, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(raw, &s.data); err != nil {
+			return nil, err
+		}
+	}
+	if s.data.Domains == nil {
+		s.data.Domains = map[string]Domain{}
+	}
+	if s.data.DomainConfigs == nil {
+		s.data.DomainConfigs = map[string]DomainConfig{}
+	}
+	if s.data.Conversations == nil {
+		s.data.Conversations = map[string]Conversation{}
+	}
+	if s.data.ScrapeJobs == nil {
+		s.data.ScrapeJobs = map[string]ScrapeJob{}
+	}
+	if s.data.Heads == nil {
+		s.data.Heads = map[string]string{}
+	}
+	if s.data.Indexes == nil {
+		s.data.Indexes = map[string][]byte{}
+	}
+	if err := s.loadEmbeddings(); err != nil {
+		return nil, err
+	}
+	fileStores[path] = s
+	return s, nil
+}
+
+// embeddingsPath is where the cached embeddings are kept, next to the store itself
+func (s *FileStore) embeddingsPath() string {
+	return strings.TrimSuffix(s.path, filepath.Ext(s.path)) + ".embeddings.jsonl"
+}
+
+// loadEmbeddings reads every cached embedding in. A crash while appending can leave a
+// partial entry at the end, which is skipped along with anything after it
+func (s *FileStore) loadEmbeddings() error {
+	s.embeddings = map[string]map[string][]float64{}
+	f, err := os.Open(s.embeddingsPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	for {
+		var entry embeddingEntry
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			log.Output(1, fmt.Sprintf("skipping the rest of %s: %s", s.embeddingsPath(), err.Error()))
+			return nil
+		}
+		if s.embeddings[entry.Model] == nil {
+			s.embeddings[entry.Model] = map[string][]float64{}
+		}
+		s.embeddings[entry.Model][entry.Hash] = entry.Embedding
+	}
+}
+
+// save writes the data out, going through a temporary file so that a crash never
+// leaves half a store behind. Callers hold s.mu
+func (s *FileStore) save() error {
+	raw, err := json.Marshal(s.data)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// snapshots returns the snapshots of domain, newest first. Callers hold s.mu
+func (s *FileStore) snapshots(domain string) []Domain {
+	res := make([]Domain, 0)
+	for _, v := range s.data.Domains {
+		if v.Domain == domain {
+			res = append(res, v)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Version > res[j].Version
+	})
+	return res
+}
+
+func (s *FileStore) GetDomain(ctx context.Context, domain string) (Domain, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var d Domain
+	if id, ok := s.data.Heads[domain]; ok {
+		d = s.data.Domains[id]
+	} else if snapshots := s.snapshots(domain); len(snapshots) > 0 {
+		// domains stored before snapshots had no head
+		d = snapshots[0]
+	} else {
+		return d, ErrNotFound
+	}
+	d.Pages = nil
+	return d, nil
+}
+
+func (s *FileStore) GetDomainById(ctx context.Context, id primitive.ObjectID) (Domain, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.data.Domains[id.Hex()]
+	if !ok {
+		return d, ErrNotFound
+	}
+	d.Pages = nil
+	return d, nil
+}
+
+func (s *FileStore) InsertSnapshot(ctx context.Context, d Domain) (Domain, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d.Id = primitive.NewObjectID()
+	d.Version = 1
+	if snapshots := s.snapshots(d.Domain); len(snapshots) > 0 {
+		d.Version = snapshots[0].Version + 1
+	}
+	d.CreatedAt = time.Now()
+	d.PageCount = len(d.Pages)
+	d.SectionCount = 0
+	for _, v := range d.Pages {
+		d.SectionCount += len(v.Sections)
+	}
+	s.data.Domains[d.Id.Hex()] = d
+	return d, s.save()
+}
+
+func (s *FileStore) ActivateSnapshot(ctx context.Context, domain string, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d, ok := s.data.Domains[id.Hex()]; !ok || d.Domain != domain {
+		return ErrNotFound
+	}
+	s.data.Heads[domain] = id.Hex()
+	return s.save()
+}
+
+func (s *FileStore) ListSnapshots(ctx context.Context, domain string) ([]Domain, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshots := s.snapshots(domain)
+	for i := range snapshots {
+		snapshots[i].Pages = nil
+	}
+	return snapshots, nil
+}
+
+func (s *FileStore) DeleteSnapshot(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.Domains[id.Hex()]; !ok {
+		return ErrNotFound
+	}
+	delete(s.data.Domains, id.Hex())
+	for _, kind := range []string{INDEX_HNSW, INDEX_BM25} {
+		delete(s.data.Indexes, indexKey(id, kind))
+	}
+	return s.save()
+}
+
+func (s *FileStore) GetPages(ctx context.Context, domainId primitive.ObjectID) ([]Page, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.data.Domains[domainId.Hex()]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	pages := make([]Page, len(d.Pages))
+	for i, v := range d.Pages {
+		v.Sections = nil
+		pages[i] = v
+	}
+	return pages, nil
+}
+
+func (s *FileStore) EachSection(ctx context.Context, domainId primitive.ObjectID, f func(p Page, s Section) error) error {
+	s.mu.Lock()
+	d, ok := s.data.Domains[domainId.Hex()]
+	s.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	// documents are replaced rather than modified, so d can be read without the lock
+	for _, page := range d.Pages {
+		sections := page.Sections
+		page.Sections = nil
+		for _, v := range sections {
+			if err := f(page, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *FileStore) GetSections(ctx context.Context, domainId primitive.ObjectID, positions []int) ([]Page, []Section, error) {
+	s.mu.Lock()
+	d, ok := s.data.Domains[domainId.Hex()]
+	s.mu.Unlock()
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+
+	return sectionsAt(d.Pages, positions)
+}
+
+// sectionsAt picks the sections at positions out of pages that hold them inline,
+// numbering them across the whole domain the way EachSection walks them
+func sectionsAt(all []Page, positions []int) ([]Page, []Section, error) {
+	wanted := make(map[int]int, len(positions)) // position to index in the result
+	for i, v := range positions {
+		wanted[v] = i
+	}
+	pages := make([]Page, len(positions))
+	sections := make([]Section, len(positions))
+	found := 0
+	position := 0
+	for _, page := range all {
+		for _, v := range page.Sections {
+			if i, ok := wanted[position]; ok {
+				pages[i] = page
+				pages[i].Sections = nil
+				sections[i] = v
+				found++
+			}
+			position++
+		}
+	}
+	if found != len(wanted) {
+		return nil, nil, ErrNotFound
+	}
+	return pages, sections, nil
+}
+
+func indexKey(domainId primitive.ObjectID, kind string) string {
+	return domainId.Hex() + "/" + kind
+}
+
+func (s *FileStore) PutIndex(ctx context.Context, domainId primitive.ObjectID, kind string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Indexes[indexKey(domainId, kind)] = data
+	return s.save()
+}
+
+func (s *FileStore) GetIndex(ctx context.Context, domainId primitive.ObjectID, kind string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.data.Indexes[indexKey(domainId, kind)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+func (s *FileStore) GetDomainConfig(ctx context.Context, domain string) (DomainConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.data.DomainConfigs {
+		if v.Domain == domain {
+			return v, nil
+		}
+	}
+	return DomainConfig{}, ErrNotFound
+}
+
+func (s *FileStore) PutDomainConfig(ctx context.Context, cfg DomainConfig) (DomainConfig, error) {
+	existing, err := s.GetDomainConfig(ctx, cfg.Domain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		cfg.Id = existing.Id
+	} else {
+		cfg.Id = primitive.NewObjectID()
+	}
+	s.data.DomainConfigs[cfg.Id.Hex()] = cfg
+	return cfg, s.save()
+}
+
+func (s *FileStore) DeleteDomainConfig(ctx context.Context, domain string) error {
+	existing, err := s.GetDomainConfig(ctx, domain)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data.DomainConfigs, existing.Id.Hex())
+	return s.save()
+}
+
+func (s *FileStore) InsertConversation(ctx context.Context, c Conversation) (Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.Id = primitive.NewObjectID()
+	s.data.Conversations[c.Id.Hex()] = c
+	return c, s.save()
+}
+
+func (s *FileStore) GetConversation(ctx context.Context, id primitive.ObjectID) (Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.data.Conversations[id.Hex()]
+	if !ok {
+		return c, ErrNotFound
+	}
+	c.migrate()
+	return c, nil
+}
+
+func (s *FileStore) UpdateConversation(ctx context.Context, c Conversation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.Conversations[c.Id.Hex()]; !ok {
+		return ErrNotFound
+	}
+	s.data.Conversations[c.Id.Hex()] = c
+	return s.save()
+}
+
+func (s *FileStore) ListConversations(ctx context.Context, filter ConversationFilter) ([]Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshots := make(map[primitive.ObjectID]bool, len(filter.DomainIds))
+	for _, v := range filter.DomainIds {
+		snapshots[v] = true
+	}
+	res := make([]Conversation, 0)
+	for _, c := range s.data.Conversations {
+		if filter.Domain != "" && c.Domain != filter.Domain && !(c.Domain == "" && snapshots[c.DomainId]) {
+			continue
+		}
+		createdAt := c.Id.Timestamp()
+		if (!filter.From.IsZero() && createdAt.Before(filter.From)) || (!filter.To.IsZero() && !createdAt.Before(filter.To)) {
+			continue
+		}
+		// the hex of ids sorts the way they do
+		if !filter.Before.IsZero() && c.Id.Hex() >= filter.Before.Hex() {
+			continue
+		}
+		c.migrate()
+		res = append(res, c)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Id.Hex() > res[j].Id.Hex()
+	})
+	if filter.Limit > 0 && len(res) > filter.Limit {
+		res = res[:filter.Limit]
+	}
+	return res, nil
+}
+
+func (s *FileStore) DeleteConversation(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.Conversations[id.Hex()]; !ok {
+		return ErrNotFound
+	}
+	delete(s.data.Conversations, id.Hex())
+	kept := s.data.UnansweredQuestions[:0]
+	for _, v := range s.data.UnansweredQuestions {
+		if v.ConversationId != id {
+			kept = append(kept, v)
+		}
+	}
+	s.data.UnansweredQuestions = kept
+	return s.save()
+}
+
+func (s *FileStore) GetEmbeddings(ctx context.Context, model string, hashes []string) (map[string][]float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(map[string][]float64)
+	for _, v := range hashes {
+		if embedding, ok := s.embeddings[model][v]; ok {
+			res[v] = embedding
+		}
+	}
+	return res, nil
+}
+
+func (s *FileStore) PutEmbeddings(ctx context.Context, model string, embeddings map[string][]float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cached, ok := s.embeddings[model]
+	if !ok {
+		cached = make(map[string][]float64)
+		s.embeddings[model] = cached
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.embeddingsPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// only what is new is appended, so a batch costs as much as its own size
+	enc := json.NewEncoder(f)
+	for k, v := range embeddings {
+		if _, ok := cached[k]; ok {
+			continue
+		}
+		if err := enc.Encode(embeddingEntry{Model: model, Hash: k, Embedding: v}); err != nil {
+			return err
+		}
+		cached[k] = v
+	}
+	return f.Close()
+}
+
+func (s *FileStore) InsertUnansweredQuestion(ctx context.Context, q UnansweredQuestion) (UnansweredQuestion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q.Id = primitive.NewObjectID()
+	s.data.UnansweredQuestions = append(s.data.UnansweredQuestions, q)
+	return q, s.save()
+}
+
+func (s *FileStore) InsertScrapeJob(ctx context.Context, job ScrapeJob) (ScrapeJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.Id = primitive.NewObjectID()
+	s.data.ScrapeJobs[job.Id.Hex()] = job
+	return job, s.save()
+}
+
+func (s *FileStore) GetScrapeJob(ctx context.Context, id primitive.ObjectID) (ScrapeJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.data.ScrapeJobs[id.Hex()]
+	if !ok {
+		return job, ErrNotFound
+	}
+	return job, nil
+}
+
+func (s *FileStore) UpdateScrapeJob(ctx context.Context, job ScrapeJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.data.ScrapeJobs[job.Id.Hex()]
+	if !ok {
+		return ErrNotFound
+	}
+	if current.State == JOB_DONE || current.State == JOB_FAILED {
+		return ErrJobFinished
+	}
+	s.data.ScrapeJobs[job.Id.Hex()] = job
+	return s.save()
+}
+
+func (s *FileStore) ClaimScrapeJob(ctx context.Context) (ScrapeJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var oldest *ScrapeJob
+	for _, v := range s.data.ScrapeJobs {
+		if v.State == JOB_QUEUED && (oldest == nil || v.CreatedAt.Before(oldest.CreatedAt)) {
+			job := v
+			oldest = &job
+		}
+	}
+	if oldest == nil {
+		return ScrapeJob{}, ErrNotFound
+	}
+	oldest.State = JOB_CRAWLING
+	oldest.UpdatedAt = time.Now()
+	s.data.ScrapeJobs[oldest.Id.Hex()] = *oldest
+	return *oldest, s.save()
+}
+
+func (s *FileStore) TouchScrapeJob(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.data.ScrapeJobs[id.Hex()]
+	if !ok {
+		return ErrNotFound
+	}
+	job.UpdatedAt = time.Now()
+	s.data.ScrapeJobs[id.Hex()] = job
+	return s.save()
+}
+
+func (s *FileStore) FailStaleScrapeJobs(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for k, v := range s.data.ScrapeJobs {
+		if v.Running() && v.UpdatedAt.Before(before) {
+			v.State = JOB_FAILED
+			v.Error = STALE_JOB_ERROR
+			v.UpdatedAt = time.Now()
+			s.data.ScrapeJobs[k] = v
+			n += 1
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.save()
+}
@@ -0,0 +1,156 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func openTestFileStore(t *testing.T) *FileStore {
+	store, err := OpenFileStore(filepath.Join(t.TempDir(), "store.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// reopenFileStore reads the file of store again, as a new process would
+func reopenFileStore(t *testing.T, store *FileStore) *FileStore {
+	fileStoresMu.Lock()
+	delete(fileStores, store.path)
+	fileStoresMu.Unlock()
+	reopened, err := OpenFileStore(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reopened
+}
+
+func TestFileStoreConversations(t *testing.T) {
+	ctx := context.Background()
+	store := openTestFileStore(t)
+
+	c, err := store.InsertConversation(ctx, Conversation{Prompt: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Id.IsZero() {
+		t.Fatal("InsertConversation left the id unset")
+	}
+	c.Prompt = "second"
+	if err := store.UpdateConversation(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := reopenFileStore(t, store).GetConversation(ctx, c.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Prompt != "second" {
+		t.Errorf("Prompt = %q after reopening, want %q", got.Prompt, "second")
+	}
+
+	missing := Conversation{Id: primitive.NewObjectID()}
+	if _, err := store.GetConversation(ctx, missing.Id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetConversation of a missing id: %v, want ErrNotFound", err)
+	}
+	if err := store.UpdateConversation(ctx, missing); !errors.Is(err, ErrNotFound) {
+		t.Errorf("UpdateConversation of a missing id: %v, want ErrNotFound", err)
+	}
+}
+
+func TestFileStoreScrapeJobs(t *testing.T) {
+	ctx := context.Background()
+	store := openTestFileStore(t)
+
+	job, err := store.InsertScrapeJob(ctx, ScrapeJob{Domain: "https://example.com", State: JOB_QUEUED})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.State, job.PageCount = JOB_DONE, 3
+	if err := store.UpdateScrapeJob(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	got, err := reopenFileStore(t, store).GetScrapeJob(ctx, job.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != JOB_DONE || got.PageCount != 3 {
+		t.Errorf("GetScrapeJob = %+v after reopening", got)
+	}
+	// a worker still running the job does not bring it back
+	job.State = JOB_UPLOADING
+	if err := store.UpdateScrapeJob(ctx, job); !errors.Is(err, ErrJobFinished) {
+		t.Errorf("UpdateScrapeJob of a finished job: %v, want ErrJobFinished", err)
+	}
+	if err := store.UpdateScrapeJob(ctx, ScrapeJob{Id: primitive.NewObjectID()}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("UpdateScrapeJob of a missing id: %v, want ErrNotFound", err)
+	}
+}
+
+func TestFileStoreListConversations(t *testing.T) {
+	ctx := context.Background()
+	store := openTestFileStore(t)
+
+	day := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	snapshot := primitive.NewObjectID()
+	ids := make([]primitive.ObjectID, 6)
+	for i := range ids {
+		ids[i] = primitive.NewObjectIDFromTimestamp(day.Add(time.Duration(i) * 6 * time.Hour))
+		c := Conversation{Id: ids[i], Domain: "example.com", Turns: []Turn{}}
+		if i == 1 {
+			// started before snapshots, known only by the snapshot it was on
+			c.Domain, c.DomainId = "", snapshot
+			c.Turns, c.Log = nil, []string{"[User]: hi"}
+		}
+		store.data.Conversations[ids[i].Hex()] = c
+	}
+	other := primitive.NewObjectIDFromTimestamp(day)
+	other[11] = 1
+	store.data.Conversations[other.Hex()] = Conversation{Id: other, Domain: "other.com"}
+
+	legacy := []primitive.ObjectID{snapshot}
+	tests := []struct {
+		name   string
+		filter ConversationFilter
+		want   []primitive.ObjectID
+	}{
+		{"all", ConversationFilter{Domain: "example.com", DomainIds: legacy},
+			[]primitive.ObjectID{ids[5], ids[4], ids[3], ids[2], ids[1], ids[0]}},
+		{"first page", ConversationFilter{Domain: "example.com", DomainIds: legacy, Limit: 2},
+			[]primitive.ObjectID{ids[5], ids[4]}},
+		{"second page", ConversationFilter{Domain: "example.com", DomainIds: legacy, Limit: 2, Before: ids[4]},
+			[]primitive.ObjectID{ids[3], ids[2]}},
+		{"last page", ConversationFilter{Domain: "example.com", DomainIds: legacy, Limit: 2, Before: ids[2]},
+			[]primitive.ObjectID{ids[1], ids[0]}},
+		{"past the end", ConversationFilter{Domain: "example.com", DomainIds: legacy, Limit: 2, Before: ids[0]},
+			[]primitive.ObjectID{}},
+		{"between", ConversationFilter{Domain: "example.com", DomainIds: legacy, From: day.Add(6 * time.Hour), To: day.Add(24 * time.Hour)},
+			[]primitive.ObjectID{ids[3], ids[2], ids[1]}},
+		{"without legacy", ConversationFilter{Domain: "example.com", Limit: 2, Before: ids[2]},
+			[]primitive.ObjectID{ids[0]}},
+		{"other domain", ConversationFilter{Domain: "other.com"},
+			[]primitive.ObjectID{other}},
+	}
+	for _, tt := range tests {
+		res, err := store.ListConversations(ctx, tt.filter)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		got := make([]primitive.ObjectID, len(res))
+		for i, v := range res {
+			got[i] = v.Id
+			if v.Id == ids[1] && (len(v.Turns) != 1 || v.Log != nil) {
+				t.Errorf("%s: legacy conversation not migrated: %+v", tt.name, v)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ids %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,720 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type MongoStore struct {
+	db         *mongo.Database
+	disconnect func()
+}
+
+func NewMongoStore() (*MongoStore, error) {
+	db, disconnect, err := GetDb()
+	if err != nil {
+		return nil, err
+	}
+	return &MongoStore{db: db, disconnect: disconnect}, nil
+}
+
+func (s *MongoStore) Close() error {
+	s.disconnect()
+	return nil
+}
+
+// findOne decodes the first document of coll matching filter into v
+func (s *MongoStore) findOne(ctx context.Context, coll string, filter interface{}, v interface{}, opts ...*options.FindOneOptions) error {
+	err := s.db.Collection(coll).FindOne(ctx, filter, opts...).Decode(v)
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	return err
+}
+
+// the pages of a domain live in the Pages collection and its sections in Sections,
+// one document each, since a whole domain with its embeddings soon outgrows the 16MB
+// a single document may hold. Domains scraped before that kept their pages inline,
+// and are still read that way until they are scraped again
+type pageDoc struct {
+	Id       primitive.ObjectID `bson:"_id,omitempty"`
+	DomainId primitive.ObjectID `bson:"domain_id"`
+	Index    int                `bson:"index"` // position of the page in the domain
+	Page     `bson:",inline"`
+}
+
+type sectionDoc struct {
+	Id       primitive.ObjectID `bson:"_id,omitempty"`
+	DomainId primitive.ObjectID `bson:"domain_id"`
+	Route    string             `bson:"route"`
+	Page     int                `bson:"page"`     // index of the page the section is on
+	Index    int                `bson:"index"`    // position of the section in its page
+	Position int                `bson:"position"` // position of the section in the domain
+	Section  `bson:",inline"`
+}
+
+// sections are written this many at a time, keeping each insert well below the
+// size limit of a request
+const MONGO_INSERT_BATCH_SIZE = 500
+
+var mongoIndexesOnce sync.Once
+
+// ensureIndexes creates the indexes the domain collections are queried by, once per
+// process. Creating an index that exists is a no-op, so nothing tracks whether it ran before
+func (s *MongoStore) ensureIndexes(ctx context.Context) {
+	mongoIndexesOnce.Do(func() {
+		indexes := map[string][]mongo.IndexModel{
+			"ScrapedDomains": {
+				{Keys: bson.D{{Key: "domain", Value: 1}, {Key: "version", Value: -1}}, Options: options.Index().SetUnique(true)},
+			},
+			"DomainHeads": {
+				{Keys: bson.D{{Key: "domain", Value: 1}}, Options: options.Index().SetUnique(true)},
+			},
+			"Pages": {
+				{Keys: bson.D{{Key: "domain_id", Value: 1}, {Key: "index", Value: 1}}},
+				{Keys: bson.D{{Key: "domain_id", Value: 1}, {Key: "route", Value: 1}}},
+			},
+			"SearchIndexes": {
+				{Keys: bson.D{{Key: "domain_id", Value: 1}, {Key: "kind", Value: 1}, {Key: "seq", Value: 1}}},
+			},
+			"Embeddings": {
+				{Keys: bson.D{{Key: "model", Value: 1}, {Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+			},
+			"Sections": {
+				{Keys: bson.D{{Key: "domain_id", Value: 1}, {Key: "page", Value: 1}, {Key: "index", Value: 1}}},
+				{Keys: bson.D{{Key: "domain_id", Value: 1}, {Key: "position", Value: 1}}},
+				{Keys: bson.D{{Key: "domain_id", Value: 1}, {Key: "route", Value: 1}}},
+			},
+			"UnansweredQuestions": {
+				{Keys: bson.D{{Key: "domain", Value: 1}, {Key: "created_at", Value: -1}}},
+			},
+			"ScrapeJobs": {
+				{Keys: bson.D{{Key: "state", Value: 1}, {Key: "created_at", Value: 1}}},
+			},
+			"Conversations": {
+				{Keys: bson.D{{Key: "domain", Value: 1}, {Key: "_id", Value: -1}}},
+				{Keys: bson.D{{Key: "domain_id", Value: 1}}},
+			},
+		}
+		for coll, models := range indexes {
+			if _, err := s.db.Collection(coll).Indexes().CreateMany(ctx, models); err != nil {
+				log.Output(1, "could not create indexes on "+coll+": "+err.Error())
+			}
+		}
+	})
+}
+
+// the pages are left out of domain lookups, see Store
+var withoutPages = options.FindOne().SetProjection(bson.M{"pages": 0})
+
+// domainHead points at the active snapshot of a domain. Swapping snapshots is a
+// single update of it, so readers see either the old snapshot or the new one
+type domainHead struct {
+	Domain    string             `bson:"domain"`
+	ActiveId  primitive.ObjectID `bson:"active_id"`
+	UpdatedAt time.Time          `bson:"updated_at"`
+}
+
+func (s *MongoStore) GetDomain(ctx context.Context, domain string) (Domain, error) {
+	var head domainHead
+	err := s.findOne(ctx, "DomainHeads", bson.M{"domain": domain}, &head)
+	if err == nil {
+		return s.GetDomainById(ctx, head.ActiveId)
+	} else if err != ErrNotFound {
+		return Domain{}, err
+	}
+
+	// domains stored before snapshots have no head, and a single version
+	var d Domain
+	err = s.findOne(ctx, "ScrapedDomains", bson.M{"domain": domain}, &d,
+		options.FindOne().SetProjection(bson.M{"pages": 0}).SetSort(bson.D{{Key: "version", Value: -1}}))
+	return d, err
+}
+
+func (s *MongoStore) GetDomainById(ctx context.Context, id primitive.ObjectID) (Domain, error) {
+	var d Domain
+	err := s.findOne(ctx, "ScrapedDomains", bson.M{"_id": id}, &d, withoutPages)
+	return d, err
+}
+
+// insertMany inserts docs into coll in batches of MONGO_INSERT_BATCH_SIZE
+func (s *MongoStore) insertMany(ctx context.Context, coll string, docs []interface{}) error {
+	for len(docs) > 0 {
+		n := MONGO_INSERT_BATCH_SIZE
+		if n > len(docs) {
+			n = len(docs)
+		}
+		if _, err := s.db.Collection(coll).InsertMany(ctx, docs[:n], options.InsertMany().SetOrdered(false)); err != nil {
+			return err
+		}
+		docs = docs[n:]
+	}
+	return nil
+}
+
+// how many times a snapshot is given the next version when another scrape of the
+// domain took it first
+const SNAPSHOT_VERSION_RETRIES = 5
+
+// insertVersioned inserts d as the version after the latest one of its domain. Versions
+// are unique per domain, so a concurrent scrape picking the same one fails the insert,
+// and the next version is tried
+func (s *MongoStore) insertVersioned(ctx context.Context, d *Domain) error {
+	for attempt := 0; ; attempt++ {
+		var latest Domain
+		err := s.findOne(ctx, "ScrapedDomains", bson.M{"domain": d.Domain}, &latest,
+			options.FindOne().SetProjection(bson.M{"version": 1}).SetSort(bson.D{{Key: "version", Value: -1}}))
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		d.Version = latest.Version + 1
+		_, err = s.db.Collection("ScrapedDomains").InsertOne(ctx, d)
+		if !mongo.IsDuplicateKeyError(err) || attempt >= SNAPSHOT_VERSION_RETRIES {
+			return err
+		}
+		log.Output(1, fmt.Sprintf("version %d of %s was taken, trying the next one", d.Version, d.Domain))
+	}
+}
+
+func (s *MongoStore) InsertSnapshot(ctx context.Context, d Domain) (Domain, error) {
+	s.ensureIndexes(ctx)
+	pages := d.Pages
+
+	d.Id = primitive.NewObjectID()
+	d.CreatedAt = time.Now()
+	d.PageCount = len(pages)
+
+	pageDocs := make([]interface{}, 0, len(pages))
+	sectionDocs := make([]interface{}, 0)
+	for i, page := range pages {
+		for j, v := range page.Sections {
+			sectionDocs = append(sectionDocs, sectionDoc{DomainId: d.Id, Route: page.Route, Page: i, Index: j, Position: len(sectionDocs), Section: v})
+		}
+		page.Sections = nil
+		pageDocs = append(pageDocs, pageDoc{DomainId: d.Id, Index: i, Page: page})
+	}
+	d.SectionCount = len(sectionDocs)
+
+	d.Pages = nil
+	if err := s.insertVersioned(ctx, &d); err != nil {
+		return d, err
+	}
+	err := s.insertMany(ctx, "Pages", pageDocs)
+	if err == nil {
+		err = s.insertMany(ctx, "Sections", sectionDocs)
+	}
+	if err != nil {
+		// don't leave half a snapshot behind
+		if err := s.DeleteSnapshot(ctx, d.Id); err != nil {
+			log.Output(1, "could not clean up snapshot "+d.Id.Hex()+": "+err.Error())
+		}
+		return d, err
+	}
+
+	d.Pages = pages
+	return d, nil
+}
+
+func (s *MongoStore) ActivateSnapshot(ctx context.Context, domain string, id primitive.ObjectID) error {
+	var d Domain
+	if err := s.findOne(ctx, "ScrapedDomains", bson.M{"_id": id, "domain": domain}, &d, withoutPages); err != nil {
+		return err
+	}
+	_, err := s.db.Collection("DomainHeads").UpdateOne(
+		ctx,
+		bson.M{"domain": domain},
+		bson.M{"$set": domainHead{Domain: domain, ActiveId: id, UpdatedAt: time.Now()}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *MongoStore) ListSnapshots(ctx context.Context, domain string) ([]Domain, error) {
+	cursor, err := s.db.Collection("ScrapedDomains").Find(
+		ctx,
+		bson.M{"domain": domain},
+		options.Find().SetProjection(bson.M{"pages": 0}).SetSort(bson.D{{Key: "version", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]Domain, 0)
+	err = cursor.All(ctx, &snapshots)
+	return snapshots, err
+}
+
+func (s *MongoStore) DeleteSnapshot(ctx context.Context, id primitive.ObjectID) error {
+	// the content goes first, so a failure never leaves it without its snapshot
+	for _, coll := range []string{"Pages", "Sections", "SearchIndexes"} {
+		if _, err := s.db.Collection(coll).DeleteMany(ctx, bson.M{"domain_id": id}); err != nil {
+			return err
+		}
+	}
+	res, err := s.db.Collection("ScrapedDomains").DeleteOne(ctx, bson.M{"_id": id})
+	if err == nil && res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+// legacyPages returns the pages a domain stored before the split kept inline, if any
+func (s *MongoStore) legacyPages(ctx context.Context, domainId primitive.ObjectID) ([]Page, error) {
+	var d Domain
+	err := s.findOne(ctx, "ScrapedDomains", bson.M{"_id": domainId}, &d)
+	return d.Pages, err
+}
+
+func (s *MongoStore) GetPages(ctx context.Context, domainId primitive.ObjectID) ([]Page, error) {
+	cursor, err := s.db.Collection("Pages").Find(ctx, bson.M{"domain_id": domainId}, options.Find().SetSort(bson.D{{Key: "index", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var docs []pageDoc
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+
+	if len(docs) == 0 {
+		pages, err := s.legacyPages(ctx, domainId)
+		for i := range pages {
+			pages[i].Sections = nil
+		}
+		return pages, err
+	}
+	pages := make([]Page, len(docs))
+	for i, v := range docs {
+		pages[i] = v.Page
+	}
+	return pages, nil
+}
+
+func (s *MongoStore) EachSection(ctx context.Context, domainId primitive.ObjectID, f func(p Page, s Section) error) error {
+	pages, err := s.GetPages(ctx, domainId)
+	if err != nil {
+		return err
+	}
+
+	cursor, err := s.db.Collection("Sections").Find(
+		ctx,
+		bson.M{"domain_id": domainId},
+		options.Find().SetSort(bson.D{{Key: "page", Value: 1}, {Key: "index", Value: 1}}),
+	)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	// the sections are decoded one at a time, so only the current batch is ever in memory
+	found := false
+	for cursor.Next(ctx) {
+		var doc sectionDoc
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		if doc.Page < 0 || doc.Page >= len(pages) {
+			return fmt.Errorf("section of %s refers to missing page %d", doc.Route, doc.Page)
+		}
+		found = true
+		if err := f(pages[doc.Page], doc.Section); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if found {
+		return nil
+	}
+
+	legacy, err := s.legacyPages(ctx, domainId)
+	if err != nil {
+		return err
+	}
+	for _, page := range legacy {
+		sections := page.Sections
+		page.Sections = nil
+		for _, v := range sections {
+			if err := f(page, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *MongoStore) GetSections(ctx context.Context, domainId primitive.ObjectID, positions []int) ([]Page, []Section, error) {
+	cursor, err := s.db.Collection("Sections").Find(
+		ctx,
+		bson.M{"domain_id": domainId, "position": bson.M{"$in": positions}},
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	var docs []sectionDoc
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, nil, err
+	}
+	if len(docs) == 0 && len(positions) > 0 {
+		// domains scraped before the split keep their sections inline
+		legacy, err := s.legacyPages(ctx, domainId)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sectionsAt(legacy, positions)
+	}
+
+	pageIdx := make([]int, len(docs))
+	for i, v := range docs {
+		pageIdx[i] = v.Page
+	}
+	cursor, err = s.db.Collection("Pages").Find(ctx, bson.M{"domain_id": domainId, "index": bson.M{"$in": pageIdx}})
+	if err != nil {
+		return nil, nil, err
+	}
+	var pageDocs []pageDoc
+	if err := cursor.All(ctx, &pageDocs); err != nil {
+		return nil, nil, err
+	}
+	pagesByIdx := make(map[int]Page, len(pageDocs))
+	for _, v := range pageDocs {
+		pagesByIdx[v.Index] = v.Page
+	}
+
+	byPosition := make(map[int]sectionDoc, len(docs))
+	for _, v := range docs {
+		byPosition[v.Position] = v
+	}
+	pages := make([]Page, len(positions))
+	sections := make([]Section, len(positions))
+	for i, v := range positions {
+		doc, ok := byPosition[v]
+		if !ok {
+			return nil, nil, ErrNotFound
+		}
+		pages[i] = pagesByIdx[doc.Page]
+		sections[i] = doc.Section
+	}
+	return pages, sections, nil
+}
+
+// an index is split over documents of this many bytes, as it can outgrow a single one
+const MONGO_INDEX_CHUNK_SIZE = 8 << 20
+
+type indexChunk struct {
+	DomainId primitive.ObjectID `bson:"domain_id"`
+	Kind     string             `bson:"kind"`
+	Seq      int                `bson:"seq"`
+	Data     []byte             `bson:"data"`
+}
+
+func (s *MongoStore) PutIndex(ctx context.Context, domainId primitive.ObjectID, kind string, data []byte) error {
+	s.ensureIndexes(ctx)
+	if _, err := s.db.Collection("SearchIndexes").DeleteMany(ctx, bson.M{"domain_id": domainId, "kind": kind}); err != nil {
+		return err
+	}
+	for seq := 0; len(data) > 0; seq++ {
+		n := MONGO_INDEX_CHUNK_SIZE
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := s.db.Collection("SearchIndexes").InsertOne(ctx, indexChunk{DomainId: domainId, Kind: kind, Seq: seq, Data: data[:n]}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func (s *MongoStore) GetIndex(ctx context.Context, domainId primitive.ObjectID, kind string) ([]byte, error) {
+	cursor, err := s.db.Collection("SearchIndexes").Find(ctx, bson.M{"domain_id": domainId, "kind": kind}, options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var chunks []indexChunk
+	if err := cursor.All(ctx, &chunks); err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 {
+		return nil, ErrNotFound
+	}
+	size := 0
+	for _, v := range chunks {
+		size += len(v.Data)
+	}
+	data := make([]byte, 0, size)
+	for _, v := range chunks {
+		data = append(data, v.Data...)
+	}
+	return data, nil
+}
+
+func (s *MongoStore) GetDomainConfig(ctx context.Context, domain string) (DomainConfig, error) {
+	var cfg DomainConfig
+	err := s.findOne(ctx, "DomainConfigs", bson.M{"domain": domain}, &cfg)
+	return cfg, err
+}
+
+func (s *MongoStore) PutDomainConfig(ctx context.Context, cfg DomainConfig) (DomainConfig, error) {
+	// the id is the stored one, never the client's
+	cfg.Id = primitive.NilObjectID
+	_, err := s.db.Collection("DomainConfigs").ReplaceOne(
+		ctx,
+		bson.M{"domain": cfg.Domain},
+		cfg,
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return cfg, err
+	}
+	return s.GetDomainConfig(ctx, cfg.Domain)
+}
+
+func (s *MongoStore) DeleteDomainConfig(ctx context.Context, domain string) error {
+	res, err := s.db.Collection("DomainConfigs").DeleteOne(ctx, bson.M{"domain": domain})
+	if err == nil && res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *MongoStore) InsertConversation(ctx context.Context, c Conversation) (Conversation, error) {
+	res, err := s.db.Collection("Conversations").InsertOne(ctx, c)
+	if err != nil {
+		return c, err
+	}
+	c.Id = res.InsertedID.(primitive.ObjectID)
+	return c, nil
+}
+
+func (s *MongoStore) GetConversation(ctx context.Context, id primitive.ObjectID) (Conversation, error) {
+	var c Conversation
+	err := s.findOne(ctx, "Conversations", bson.M{"_id": id}, &c)
+	c.migrate()
+	return c, err
+}
+
+func (s *MongoStore) UpdateConversation(ctx context.Context, c Conversation) error {
+	res, err := s.db.Collection("Conversations").ReplaceOne(ctx, bson.M{"_id": c.Id}, c)
+	if err == nil && res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+// ListConversations pages by _id, which starts with the time a conversation was
+// inserted, so that date filters need no field of their own and work on
+// conversations saved before there were any
+func (s *MongoStore) ListConversations(ctx context.Context, filter ConversationFilter) ([]Conversation, error) {
+	s.ensureIndexes(ctx)
+	query := bson.M{}
+	if filter.Domain != "" && len(filter.DomainIds) > 0 {
+		query["$or"] = bson.A{
+			bson.M{"domain": filter.Domain},
+			bson.M{"domain": bson.M{"$in": bson.A{"", nil}}, "domain_id": bson.M{"$in": filter.DomainIds}},
+		}
+	} else if filter.Domain != "" {
+		query["domain"] = filter.Domain
+	}
+	ids := bson.M{}
+	if !filter.From.IsZero() {
+		ids["$gte"] = primitive.NewObjectIDFromTimestamp(filter.From)
+	}
+	before := filter.Before
+	if !filter.To.IsZero() {
+		if to := primitive.NewObjectIDFromTimestamp(filter.To); before.IsZero() || to.Hex() < before.Hex() {
+			before = to
+		}
+	}
+	if !before.IsZero() {
+		ids["$lt"] = before
+	}
+	if len(ids) > 0 {
+		query["_id"] = ids
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}})
+	if filter.Limit > 0 {
+		opts.SetLimit(int64(filter.Limit))
+	}
+	cursor, err := s.db.Collection("Conversations").Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Conversation, 0)
+	if err := cursor.All(ctx, &res); err != nil {
+		return nil, err
+	}
+	for i := range res {
+		res[i].migrate()
+	}
+	return res, nil
+}
+
+func (s *MongoStore) DeleteConversation(ctx context.Context, id primitive.ObjectID) error {
+	// the questions go first, so a failure never leaves them without their conversation
+	if _, err := s.db.Collection("UnansweredQuestions").DeleteMany(ctx, bson.M{"conversation_id": id}); err != nil {
+		return err
+	}
+	res, err := s.db.Collection("Conversations").DeleteOne(ctx, bson.M{"_id": id})
+	if err == nil && res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+// cachedEmbedding is an embedding of an input made by a model, keyed by the
+// ContentHash of the input, so the input itself is never stored
+type cachedEmbedding struct {
+	Model     string    `bson:"model"`
+	Hash      string    `bson:"hash"`
+	Embedding []float64 `bson:"embedding"`
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+func (s *MongoStore) GetEmbeddings(ctx context.Context, model string, hashes []string) (map[string][]float64, error) {
+	res := make(map[string][]float64)
+	if len(hashes) == 0 {
+		return res, nil
+	}
+	cursor, err := s.db.Collection("Embeddings").Find(ctx, bson.M{"model": model, "hash": bson.M{"$in": hashes}})
+	if err != nil {
+		return nil, err
+	}
+	var docs []cachedEmbedding
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	for _, v := range docs {
+		res[v.Hash] = v.Embedding
+	}
+	return res, nil
+}
+
+func (s *MongoStore) PutEmbeddings(ctx context.Context, model string, embeddings map[string][]float64) error {
+	s.ensureIndexes(ctx)
+	writes := make([]mongo.WriteModel, 0, len(embeddings))
+	now := time.Now()
+	for k, v := range embeddings {
+		writes = append(writes, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"model": model, "hash": k}).
+			SetReplacement(cachedEmbedding{Model: model, Hash: k, Embedding: v, CreatedAt: now}).
+			SetUpsert(true))
+	}
+	for len(writes) > 0 {
+		n := MONGO_INSERT_BATCH_SIZE
+		if n > len(writes) {
+			n = len(writes)
+		}
+		if _, err := s.db.Collection("Embeddings").BulkWrite(ctx, writes[:n], options.BulkWrite().SetOrdered(false)); err != nil {
+			return err
+		}
+		writes = writes[n:]
+	}
+	return nil
+}
+
+func (s *MongoStore) InsertUnansweredQuestion(ctx context.Context, q UnansweredQuestion) (UnansweredQuestion, error) {
+	s.ensureIndexes(ctx)
+	res, err := s.db.Collection("UnansweredQuestions").InsertOne(ctx, q)
+	if err != nil {
+		return q, err
+	}
+	q.Id = res.InsertedID.(primitive.ObjectID)
+	return q, nil
+}
+
+func (s *MongoStore) InsertScrapeJob(ctx context.Context, job ScrapeJob) (ScrapeJob, error) {
+	res, err := s.db.Collection("ScrapeJobs").InsertOne(ctx, job)
+	if err != nil {
+		return job, err
+	}
+	job.Id = res.InsertedID.(primitive.ObjectID)
+	return job, nil
+}
+
+func (s *MongoStore) GetScrapeJob(ctx context.Context, id primitive.ObjectID) (ScrapeJob, error) {
+	var job ScrapeJob
+	err := s.findOne(ctx, "ScrapeJobs", bson.M{"_id": id}, &job)
+	return job, err
+}
+
+// UpdateScrapeJob only sets what a job changes as it runs, and only while it is not
+// finished, so that a worker still running a job the stale job sweep gave up on cannot
+// bring it back
+func (s *MongoStore) UpdateScrapeJob(ctx context.Context, job ScrapeJob) error {
+	raw, err := bson.Marshal(job)
+	if err != nil {
+		return err
+	}
+	var progress bson.M
+	if err := bson.Unmarshal(raw, &progress); err != nil {
+		return err
+	}
+	// set once the job is queued
+	for _, v := range []string{"_id", "domain", "depth", "mode", "created_at"} {
+		delete(progress, v)
+	}
+
+	res, err := s.db.Collection("ScrapeJobs").UpdateOne(
+		ctx,
+		bson.M{"_id": job.Id, "state": bson.M{"$nin": bson.A{JOB_DONE, JOB_FAILED}}},
+		bson.M{"$set": progress},
+	)
+	if err != nil || res.MatchedCount > 0 {
+		return err
+	}
+	n, err := s.db.Collection("ScrapeJobs").CountDocuments(ctx, bson.M{"_id": job.Id})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return ErrJobFinished
+}
+
+func (s *MongoStore) ClaimScrapeJob(ctx context.Context) (ScrapeJob, error) {
+	s.ensureIndexes(ctx)
+	var job ScrapeJob
+	err := s.db.Collection("ScrapeJobs").FindOneAndUpdate(
+		ctx,
+		bson.M{"state": JOB_QUEUED},
+		bson.M{"$set": bson.M{"state": JOB_CRAWLING, "updated_at": time.Now()}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetReturnDocument(options.After),
+	).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return job, ErrNotFound
+	}
+	return job, err
+}
+
+func (s *MongoStore) TouchScrapeJob(ctx context.Context, id primitive.ObjectID) error {
+	res, err := s.db.Collection("ScrapeJobs").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"updated_at": time.Now()}})
+	if err == nil && res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *MongoStore) FailStaleScrapeJobs(ctx context.Context, before time.Time) (int, error) {
+	res, err := s.db.Collection("ScrapeJobs").UpdateMany(
+		ctx,
+		bson.M{
+			"state":      bson.M{"$in": bson.A{JOB_CRAWLING, JOB_EMBEDDING, JOB_UPLOADING}},
+			"updated_at": bson.M{"$lt": before},
+		},
+		bson.M{"$set": bson.M{"state": JOB_FAILED, "error": STALE_JOB_ERROR, "updated_at": time.Now()}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.ModifiedCount), nil
+}
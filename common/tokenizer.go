@@ -0,0 +1,272 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Tokenizer counts the tokens of text the way the models it is for do, to fit text
+// into their limits
+type Tokenizer interface {
+	Count(text string) int
+}
+
+// WordTokenizer counts words. It is the fallback when there is no vocabulary to load,
+// and undercounts, punctuation-heavy text like code the most
+type WordTokenizer struct{}
+
+func (WordTokenizer) Count(text string) int {
+	return len(wordRe.FindAllStringIndex(text, -1))
+}
+
+// BPETokenizer is a byte pair encoding tokenizer compatible with tiktoken's
+// cl100k_base, the encoding of the OpenAI chat and embedding models. It needs the
+// ranks of that encoding, as distributed in cl100k_base.tiktoken
+type BPETokenizer struct {
+	ranks map[string]int
+}
+
+// LoadBPE reads ranks in the tiktoken format: a base64 encoded token and its rank on
+// every line
+func LoadBPE(r io.Reader) (*BPETokenizer, error) {
+	t := &BPETokenizer{ranks: make(map[string]int)}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a token and its rank", line)
+		}
+		token, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		t.ranks[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	// every byte must be a token, or some text could not be encoded
+	for b := 0; b < 256; b++ {
+		if _, ok := t.ranks[string([]byte{byte(b)})]; !ok {
+			return nil, fmt.Errorf("byte %d is not a token", b)
+		}
+	}
+	return t, nil
+}
+
+func (t *BPETokenizer) Encode(text string) []int {
+	res := make([]int, 0)
+	for _, piece := range splitCl100k(text) {
+		res = append(res, t.encodePiece([]byte(piece))...)
+	}
+	return res
+}
+
+func (t *BPETokenizer) Count(text string) int {
+	n := 0
+	for _, piece := range splitCl100k(text) {
+		n += len(t.encodePiece([]byte(piece)))
+	}
+	return n
+}
+
+// encodePiece merges the pair of adjacent parts of piece whose merge ranks lowest,
+// starting from single bytes, until no merge is a token
+func (t *BPETokenizer) encodePiece(piece []byte) []int {
+	if rank, ok := t.ranks[string(piece)]; ok {
+		return []int{rank}
+	}
+
+	// the parts are piece[bounds[i]:bounds[i+1]]
+	bounds := make([]int, len(piece)+1)
+	for i := range bounds {
+		bounds[i] = i
+	}
+	for len(bounds) > 2 {
+		best, bestRank := -1, 0
+		for i := 0; i+2 < len(bounds); i++ {
+			rank, ok := t.ranks[string(piece[bounds[i]:bounds[i+2]])]
+			if ok && (best < 0 || rank < bestRank) {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		bounds = append(bounds[:best+1], bounds[best+2:]...)
+	}
+
+	res := make([]int, len(bounds)-1)
+	for i := range res {
+		res[i] = t.ranks[string(piece[bounds[i]:bounds[i+1]])]
+	}
+	return res
+}
+
+func isNewline(r rune) bool {
+	return r == '\r' || r == '\n'
+}
+
+func isLetter(r rune) bool {
+	return unicode.IsLetter(r)
+}
+
+func isNumber(r rune) bool {
+	return unicode.IsNumber(r)
+}
+
+// isSymbol is [^\s\p{L}\p{N}]
+func isSymbol(r rune) bool {
+	return !unicode.IsSpace(r) && !isLetter(r) && !isNumber(r)
+}
+
+var contractions = []string{"s", "t", "re", "ve", "m", "ll", "d"}
+
+// splitCl100k cuts text into the pieces cl100k_base encodes separately, as its
+// pattern would:
+//
+//	(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+//
+// Go's regexp has no lookahead, so the alternatives are tried by hand, in order
+func splitCl100k(text string) []string {
+	runes := []rune(text)
+	res := make([]string, 0)
+	for i := 0; i < len(runes); {
+		n := matchCl100k(runes, i)
+		res = append(res, string(runes[i:i+n]))
+		i += n
+	}
+	return res
+}
+
+// matchCl100k returns the length of the piece starting at runes[i]
+func matchCl100k(runes []rune, i int) int {
+	n := len(runes)
+
+	// (?i:'s|'t|'re|'ve|'m|'ll|'d)
+	if runes[i] == '\'' {
+		for _, v := range contractions {
+			if i+1+len(v) <= n && strings.EqualFold(string(runes[i+1:i+1+len(v)]), v) {
+				return 1 + len(v)
+			}
+		}
+	}
+
+	// [^\r\n\p{L}\p{N}]?\p{L}+
+	j := i
+	if !isNewline(runes[j]) && !isLetter(runes[j]) && !isNumber(runes[j]) && j+1 < n && isLetter(runes[j+1]) {
+		j++
+	}
+	if isLetter(runes[j]) {
+		for j < n && isLetter(runes[j]) {
+			j++
+		}
+		return j - i
+	}
+
+	// \p{N}{1,3}
+	if isNumber(runes[i]) {
+		j = i
+		for j < n && j-i < 3 && isNumber(runes[j]) {
+			j++
+		}
+		return j - i
+	}
+
+	// ?[^\s\p{L}\p{N}]+[\r\n]*
+	j = i
+	if runes[j] == ' ' && j+1 < n && isSymbol(runes[j+1]) {
+		j++
+	}
+	if isSymbol(runes[j]) {
+		for j < n && isSymbol(runes[j]) {
+			j++
+		}
+		for j < n && isNewline(runes[j]) {
+			j++
+		}
+		return j - i
+	}
+
+	// what is left starts with whitespace
+	end := i
+	lastNewline := -1
+	for end < n && unicode.IsSpace(runes[end]) {
+		if isNewline(runes[end]) {
+			lastNewline = end
+		}
+		end++
+	}
+	// \s*[\r\n]+
+	if lastNewline >= 0 {
+		return lastNewline + 1 - i
+	}
+	// \s+(?!\S) leaves the last space to the word after it
+	if end < n && end-i > 1 {
+		return end - i - 1
+	}
+	// \s+
+	return end - i
+}
+
+// the vocabulary of BPETokenizer is looked for in vocab, so that placing it there
+// embeds it into the build, then at TOKENIZER_VOCAB
+const CL100K_VOCAB_FILE = "cl100k_base.tiktoken"
+
+//go:generate curl -sSfo vocab/cl100k_base.tiktoken https://openaipublic.blob.core.windows.net/encodings/cl100k_base.tiktoken
+//go:embed vocab
+var vocabFS embed.FS
+
+var tokenizerOnce sync.Once
+var tokenizer Tokenizer
+
+func loadTokenizer() (Tokenizer, error) {
+	raw, err := vocabFS.ReadFile("vocab/" + CL100K_VOCAB_FILE)
+	if err != nil {
+		path := os.Getenv("TOKENIZER_VOCAB")
+		if path == "" {
+			return nil, fmt.Errorf("%s is not embedded and TOKENIZER_VOCAB is not set", CL100K_VOCAB_FILE)
+		}
+		raw, err = os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return LoadBPE(bytes.NewReader(raw))
+}
+
+// GetTokenizer returns the cl100k_base tokenizer, or a WordTokenizer if its
+// vocabulary cannot be loaded
+func GetTokenizer() Tokenizer {
+	tokenizerOnce.Do(func() {
+		t, err := loadTokenizer()
+		if err != nil {
+			log.Output(1, "counting words instead of tokens: "+err.Error())
+			tokenizer = WordTokenizer{}
+			return
+		}
+		tokenizer = t
+	})
+	return tokenizer
+}
+
+func CountTokens(text string) int {
+	return GetTokenizer().Count(text)
+}
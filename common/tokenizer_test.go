@@ -0,0 +1,100 @@
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSplitCl100k(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", []string{}},
+		{"hello world", []string{"hello", " world"}},
+		{"tiktoken is great!", []string{"tiktoken", " is", " great", "!"}},
+		{"I'm  here\n\nok", []string{"I", "'m", " ", " here", "\n\n", "ok"}},
+		{"THEY'LL", []string{"THEY", "'LL"}},
+		{"12345", []string{"123", "45"}},
+		{"a+b", []string{"a", "+b"}},
+		{"x = y;\n", []string{"x", " =", " y", ";\n"}},
+		{"end   ", []string{"end", "   "}},
+		{"  \n  x", []string{"  \n", " ", " x"}},
+		{"héllo wörld", []string{"héllo", " wörld"}},
+	}
+	for _, tt := range tests {
+		if got := splitCl100k(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitCl100k(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+// testVocab is every byte, ranked by value, followed by merges in order
+func testVocab(t *testing.T, merges ...string) *BPETokenizer {
+	var buf bytes.Buffer
+	for b := 0; b < 256; b++ {
+		fmt.Fprintf(&buf, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(b)}), b)
+	}
+	for i, v := range merges {
+		fmt.Fprintf(&buf, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(v)), 256+i)
+	}
+	tok, err := LoadBPE(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+func TestBPEEncode(t *testing.T) {
+	tok := testVocab(t, "ab", "abc", "bc", " d")
+	tests := []struct {
+		text string
+		want []int
+	}{
+		{"abc", []int{257}},
+		// ab ranks before bc, so it is merged first
+		{"abcx", []int{257, 'x'}},
+		{"bcb", []int{258, 'b'}},
+		{"ab dab", []int{256, 259, 256}},
+		{"é", []int{0xc3, 0xa9}},
+	}
+	for _, tt := range tests {
+		if got := tok.Encode(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Encode(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+		if got := tok.Count(tt.text); got != len(tt.want) {
+			t.Errorf("Count(%q) = %d, want %d", tt.text, got, len(tt.want))
+		}
+	}
+}
+
+func TestLoadBPEMissingByte(t *testing.T) {
+	if _, err := LoadBPE(bytes.NewBufferString("YQ== 0\n")); err == nil {
+		t.Error("expected an error for a vocabulary missing bytes")
+	}
+}
+
+func TestCl100kCounts(t *testing.T) {
+	tok, ok := GetTokenizer().(*BPETokenizer)
+	if !ok || len(tok.ranks) < 100000 {
+		t.Fatal("the cl100k_base vocabulary is missing, see common/vocab/README.md")
+	}
+	tests := []struct {
+		text string
+		want []int
+	}{
+		{"hello world", []int{15339, 1917}},
+		{"tiktoken is great!", []int{83, 1609, 5963, 374, 2294, 0}},
+	}
+	for _, tt := range tests {
+		if got := tok.Encode(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Encode(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+		if got := tok.Count(tt.text); got != len(tt.want) {
+			t.Errorf("Count(%q) = %d, want %d", tt.text, got, len(tt.want))
+		}
+	}
+}
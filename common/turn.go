@@ -0,0 +1,85 @@
+package common
+
+import (
+	"strings"
+	"time"
+)
+
+// TokenUsage is what a completion cost. Servers that do not report it, and streams,
+// get it counted with CountTokens instead, which Estimated tells
+type TokenUsage struct {
+	PromptTokens     int  `json:"prompt_tokens" bson:"prompt_tokens"`
+	CompletionTokens int  `json:"completion_tokens" bson:"completion_tokens"`
+	TotalTokens      int  `json:"total_tokens" bson:"total_tokens"`
+	Estimated        bool `json:"estimated,omitempty" bson:"estimated,omitempty"`
+}
+
+// Turn is a message of a conversation. The fields after CreatedAt are only set on
+// answers: how their sources were found, and what generating them took
+type Turn struct {
+	Role      string    `json:"role" bson:"role"` // ROLE_USER or ROLE_ASSISTANT
+	Content   string    `json:"content" bson:"content"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+
+	Query     string      `json:"query,omitempty" bson:"query,omitempty"`
+	Sources   []Source    `json:"sources,omitempty" bson:"sources,omitempty"`
+	Model     string      `json:"model,omitempty" bson:"model,omitempty"`
+	LatencyMs int64       `json:"latency_ms,omitempty" bson:"latency_ms,omitempty"`
+	Usage     *TokenUsage `json:"usage,omitempty" bson:"usage,omitempty"`
+}
+
+func (t Turn) Message() ChatMessage {
+	return ChatMessage{Role: t.Role, Content: t.Content}
+}
+
+// String writes the turn the way the legacy logs did
+func (t Turn) String() string {
+	if t.Role == ROLE_ASSISTANT {
+		return "[Agent]: " + t.Content
+	}
+	return "[User]: " + t.Content
+}
+
+// finish stamps an answer whose generation began at start
+func (t *Turn) finish(start time.Time) {
+	t.CreatedAt = time.Now()
+	t.LatencyMs = time.Since(start).Milliseconds()
+}
+
+func turnMessages(turns []Turn) []ChatMessage {
+	messages := make([]ChatMessage, 0, len(turns))
+	for _, v := range turns {
+		messages = append(messages, v.Message())
+	}
+	return messages
+}
+
+// migrate moves a conversation saved before turns, as a log of prefixed lines and the
+// retrievals of its answers, to Turns. The log has no timestamps, so every turn gets
+// the creation time of the conversation. Conversations with turns are left as they
+// are; the legacy fields are dropped the next time the conversation is saved
+func (c *Conversation) migrate() {
+	if len(c.Turns) > 0 || len(c.Log) == 0 {
+		c.Log, c.Retrievals = nil, nil
+		return
+	}
+
+	createdAt := c.Id.Timestamp()
+	turns := make([]Turn, 0, len(c.Log))
+	for _, v := range c.Log {
+		turn := Turn{Role: ROLE_USER, Content: strings.TrimPrefix(v, "[User]: "), CreatedAt: createdAt}
+		if strings.HasPrefix(v, "[Agent]: ") {
+			turn.Role = ROLE_ASSISTANT
+			turn.Content = strings.TrimPrefix(v, "[Agent]: ")
+		}
+		turns = append(turns, turn)
+	}
+	for _, v := range c.Retrievals {
+		if v.Turn >= 0 && v.Turn < len(turns) {
+			turns[v.Turn].Query = v.Query
+			turns[v.Turn].Sources = v.Sources
+		}
+	}
+	c.Turns = turns
+	c.Log, c.Retrievals = nil, nil
+}
@@ -0,0 +1,50 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestConversationMigrate(t *testing.T) {
+	createdAt := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	id := primitive.NewObjectIDFromTimestamp(createdAt)
+	sources := []Source{{Url: "https://example.com/a"}}
+	existing := []Turn{{Role: ROLE_USER, Content: "hi", CreatedAt: time.Now()}}
+	tests := []struct {
+		name  string
+		convo Conversation
+		want  []Turn
+	}{
+		{"empty", Conversation{Id: id}, nil},
+		{"legacy", Conversation{
+			Id:  id,
+			Log: []string{"[User]: where is my order?", "[Agent]: [User]: it shipped", "no prefix"},
+			Retrievals: []Retrieval{
+				{Turn: 1, Query: "order status", Sources: sources},
+				{Turn: 7, Query: "out of range"},
+			},
+		}, []Turn{
+			{Role: ROLE_USER, Content: "where is my order?", CreatedAt: createdAt},
+			{Role: ROLE_ASSISTANT, Content: "[User]: it shipped", CreatedAt: createdAt, Query: "order status", Sources: sources},
+			{Role: ROLE_USER, Content: "no prefix", CreatedAt: createdAt},
+		}},
+		{"already migrated", Conversation{
+			Id:    id,
+			Turns: existing,
+			Log:   []string{"[User]: stale"},
+		}, existing},
+	}
+	for _, tt := range tests {
+		c := tt.convo
+		c.migrate()
+		if !reflect.DeepEqual(c.Turns, tt.want) {
+			t.Errorf("%s: Turns = %+v, want %+v", tt.name, c.Turns, tt.want)
+		}
+		if c.Log != nil || c.Retrievals != nil {
+			t.Errorf("%s: legacy fields kept: %v %v", tt.name, c.Log, c.Retrievals)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UnanswerableError is returned when no section of a domain is similar enough to a
+// question to answer it from, see RetrievalSettings.MinSimilarity
+type UnanswerableError struct {
+	BestSimilarity float64
+	MinSimilarity  float64
+}
+
+func (e *UnanswerableError) Error() string {
+	return fmt.Sprintf("no section is relevant to the question, the best has a similarity of %.3f, below %.3f", e.BestSimilarity, e.MinSimilarity)
+}
+
+// UnansweredQuestion is a question a domain had no content for, kept so that whoever
+// writes the content can fill the gap
+type UnansweredQuestion struct {
+	Id             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Domain         string             `bson:"domain" json:"domain"`
+	DomainId       primitive.ObjectID `bson:"domain_id" json:"domain_id"` // the snapshot it was asked of
+	ConversationId primitive.ObjectID `bson:"conversation_id" json:"conversation_id"`
+	Question       string             `bson:"question" json:"question"`
+	BestSimilarity float64            `bson:"best_similarity" json:"best_similarity"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// RecordUnanswered stores question of conv as unanswered. It only logs failures, as
+// the answer has been given by then
+func RecordUnanswered(ctx context.Context, store Store, conv Conversation, question string, err *UnanswerableError) {
+	_, insertErr := store.InsertUnansweredQuestion(ctx, UnansweredQuestion{
+		Domain:         conv.Domain,
+		DomainId:       conv.DomainId,
+		ConversationId: conv.Id,
+		Question:       question,
+		BestSimilarity: err.BestSimilarity,
+		CreatedAt:      time.Now().UTC(),
+	})
+	if insertErr != nil {
+		log.Output(1, "could not record an unanswered question: "+insertErr.Error())
+	}
+}
@@ -1,18 +1,33 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 
-	"github.com/passage-inc/chatassist/packages/vercel/api/continue_convo_go"
-	"github.com/passage-inc/chatassist/packages/vercel/api/initialize_convo_go"
+	"github.com/passage-inc/chatassist/packages/vercel/api/continue_convo"
+	"github.com/passage-inc/chatassist/packages/vercel/api/conversations"
+	"github.com/passage-inc/chatassist/packages/vercel/api/domain_config"
+	"github.com/passage-inc/chatassist/packages/vercel/api/domain_versions"
+	"github.com/passage-inc/chatassist/packages/vercel/api/initialize_convo"
 	"github.com/passage-inc/chatassist/packages/vercel/api/scrape"
+	"github.com/passage-inc/chatassist/packages/vercel/api/search"
 )
 
 func main() {
 	http.HandleFunc("/scrape", scrape.Handler)
+	http.HandleFunc("/scrape/", scrape.Handler)
 	http.HandleFunc("/continue_convo", continue_convo_go.Handler)
 	http.HandleFunc("/initialize_convo", initialize_convo_go.Handler)
+	http.HandleFunc("/domain_config", domain_config.Handler)
+	http.HandleFunc("/domain_versions", domain_versions.Handler)
+	http.HandleFunc("/search", search.Handler)
+	http.HandleFunc("/conversations", conversations.Handler)
+	http.HandleFunc("/conversations/", conversations.Handler)
+	http.HandleFunc("/domains/", conversations.Handler)
+	// the dev server runs the queued scrape jobs itself, which also lets it share a
+	// file store with them
+	go scrape.Work(context.Background())
 	log.Output(1, "up")
 	http.ListenAndServe(":3001", nil)
 